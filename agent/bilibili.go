@@ -1,13 +1,22 @@
 package agent
 
 import (
+	"cmp"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"internal/utils"
 
@@ -33,20 +42,152 @@ type Bilibili struct {
 	Url      string
 	SessData string
 
+	credential *BilibiliCredential
+	jar        *utils.CookieJar
+
+	// see ensureCredential, credentialMu guards credentialCheckedAt and
+	// serializes the checks
+	credentialMu        sync.Mutex
+	credentialCheckedAt time.Time
+	onCredentialRefresh func(*BilibiliCredential)
+
+	options        downloader.AgentOptions
 	httpClient     *utils.CachedHttpClient
+	wbi            *wbiSigner
 	vt             videoType
 	resourceInfos  []downloader.ResourceInfo
 	infoAcquired   bool
 	downloadParams map[string]string
+
+	// set for interactive videos
+	interactiveGraph *interactiveGraph
+
+	// see getContentLength
+	sizesMu sync.Mutex
+	sizes   map[string]probedSize
 }
 
 func NewBilibili(url string, sessData string) *Bilibili {
-	return &Bilibili{
+	return NewBilibiliWithOptions(url, sessData, downloader.AgentOptions{})
+}
+
+// NewBilibiliWithOptions is NewBilibili with the http client, user agent and
+// headers given by options.
+func NewBilibiliWithOptions(url string, sessData string, options downloader.AgentOptions) *Bilibili {
+	client := options.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	if options.Transport != nil {
+		copied := *client
+		copied.Transport = options.Transport
+		client = &copied
+	}
+	b := &Bilibili{
 		Url:            url,
 		SessData:       sessData,
-		httpClient:     utils.NewCachedHttpClient(),
+		jar:            utils.NewCookieJar(),
+		options:        options,
+		httpClient:     utils.NewCachedHttpClientFrom(client),
+		wbi:            newWbiSigner(),
 		downloadParams: make(map[string]string),
 	}
+	if sessData != "" {
+		b.jar.Add(&http.Cookie{Name: "SESSDATA", Value: sessData, Domain: ".bilibili.com"})
+	}
+	b.httpClient.SetCookieJar(b.jar)
+	b.httpClient.SetRateLimit("*.bilibili.com", defaultRateLimit)
+	return b
+}
+
+// requests per second to each host of bilibili.com unless set otherwise.
+// The CDN hosts serving streams are not limited.
+const defaultRateLimit = 4
+
+// warnf reports a problem the agent works around, on the standard logger.
+func warnf(format string, args ...any) {
+	log.Printf("bilibili: "+format, args...)
+}
+
+// SetCredential adds the cookies of credential to the cookie jar of the agent.
+func (b *Bilibili) SetCredential(credential *BilibiliCredential) {
+	b.credential = credential
+	b.jar.Add(credential.Cookies...)
+}
+
+// AddCookies adds cookies, e.g. loaded with utils.LoadCookieFile, to the
+// cookie jar of the agent. The jar applies them by domain to every request,
+// including the ones to the CDN.
+func (b *Bilibili) AddCookies(cookies ...*http.Cookie) {
+	b.jar.Add(cookies...)
+}
+
+// SetCacheDir keeps the responses of pages and APIs in directory dir, so
+// later runs do not fetch them again while they are fresh, see cacheTtl.
+func (b *Bilibili) SetCacheDir(dir string) error {
+	return b.httpClient.SetDiskCache(dir, cacheTtl)
+}
+
+// SetCacheLimits limits the responses kept in memory to maxEntries and
+// maxBytes in total, 0 meaning unlimited. The defaults are
+// utils.DefaultCacheEntries and utils.DefaultCacheBytes.
+func (b *Bilibili) SetCacheLimits(maxEntries int, maxBytes int64) {
+	b.httpClient.SetCacheLimits(maxEntries, maxBytes)
+}
+
+// CacheStats returns the statistics of the responses kept in memory.
+func (b *Bilibili) CacheStats() utils.CacheStats {
+	return b.httpClient.CacheStats()
+}
+
+// DisableCache makes the agent fetch every page and API response again,
+// neither in memory nor on disk.
+func (b *Bilibili) DisableCache() {
+	b.httpClient.DisableCache()
+}
+
+// cacheTtl tells how long responses stay fresh in the disk cache. Pages of
+// videos embed stream urls which expire after about two hours, so they are
+// kept shortly; responses depending on the login state or changing all the
+// time are not kept at all.
+func cacheTtl(u *url.URL) time.Duration {
+	switch {
+	case u.Host == "passport.bilibili.com",
+		strings.HasPrefix(u.Host, "api.live."),
+		u.Path == "/x/web-interface/nav",
+		isWbiUrl(u.String()):
+		return 0
+	case u.Path == "/x/player/pagelist",
+		strings.HasPrefix(u.Path, "/x/polymer/space/"),
+		strings.HasPrefix(u.Path, "/x/space/"):
+		return time.Hour
+	case strings.HasPrefix(u.Path, "/video/"),
+		strings.HasPrefix(u.Path, "/bangumi/play/"):
+		return 10 * time.Minute
+	}
+	return 5 * time.Minute
+}
+
+// SetMaxAttempts sets how many times a request failing with a transient
+// error, e.g. a timeout or a 412 when throttled, is sent.
+func (b *Bilibili) SetMaxAttempts(n int) {
+	b.httpClient.SetMaxAttempts(n)
+}
+
+// SetRateLimit limits the requests to the hosts matching pattern, e.g.
+// "api.bilibili.com" or "*.bilibili.com", to rate per second, 0 meaning
+// unlimited. Hosts answering with 412 are slowed down further.
+func (b *Bilibili) SetRateLimit(pattern string, rate float64) {
+	b.httpClient.SetRateLimit(pattern, rate)
+}
+
+// SetProxy sends the requests to the hosts matching pattern, e.g.
+// "*.bilibili.com" or "*" for every host, through proxy, an http, https or
+// socks5 url which may carry a username and password. "direct" connects
+// without proxy. Proxies cannot be set when the options of the agent give a
+// transport.
+func (b *Bilibili) SetProxy(pattern string, proxy string) error {
+	return b.httpClient.SetProxy(pattern, proxy)
 }
 
 type videoType int
@@ -99,6 +240,19 @@ var streamTypes = map[int]streamtype{
 	1: {Id: "jpg", Quality: 0},
 }
 
+type audiostreamtype struct {
+	Id   string
+	Desc string
+}
+
+var audioStreamTypes = map[int]audiostreamtype{
+	30216: {Id: "audio-64k", Desc: "64K"},
+	30232: {Id: "audio-132k", Desc: "132K"},
+	30280: {Id: "audio-192k", Desc: "192K"},
+	30250: {Id: "audio-dolby", Desc: "杜比全景声"},
+	30251: {Id: "audio-hires", Desc: "Hi-Res无损"},
+}
+
 func heightToQuality(height int, qn int) int {
 	var quality int
 	switch {
@@ -118,10 +272,11 @@ func heightToQuality(height int, qn int) int {
 	return quality
 }
 
-func getHeader(referer string, cookie string) map[string]string {
-	// a reasonable UA
-	ua := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.84 Safari/537.36"
-	headers := map[string]string{"Accept": "*/*", "Accept-Language": "en-US,en;q=0.5", "User-Agent": ua}
+// a reasonable UA, used unless the options of the agent give one
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+
+func defaultHeader(referer string, cookie string) map[string]string {
+	headers := map[string]string{"Accept": "*/*", "Accept-Language": "en-US,en;q=0.5", "User-Agent": defaultUserAgent}
 	if referer != "" {
 		headers["referer"] = referer
 	}
@@ -131,8 +286,29 @@ func getHeader(referer string, cookie string) map[string]string {
 	return headers
 }
 
+// getHeader returns the headers of a request, see defaultHeader, with the
+// user agent and the header overrides of the options of the agent.
+func (b *Bilibili) getHeader(referer string, cookie string) map[string]string {
+	headers := defaultHeader(referer, cookie)
+	if b.options.UserAgent != "" {
+		headers["User-Agent"] = b.options.UserAgent
+	}
+	for k, v := range b.options.Header {
+		for existing := range headers {
+			if strings.EqualFold(existing, k) {
+				delete(headers, existing)
+			}
+		}
+		if v != "" {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// apiUrl needs WBI signing, which is done by getContent.
 func apiUrl(avid string, cid string, qn int) string {
-	return fmt.Sprintf("https://api.bilibili.com/x/player/playurl?avid=%s&cid=%s&qn=%d&type=&otype=json&fnver=0&fnval=16&fourk=1", avid, cid, qn)
+	return fmt.Sprintf("https://api.bilibili.com/x/player/wbi/playurl?avid=%s&cid=%s&qn=%d&type=&otype=json&fnver=0&fnval=16&fourk=1", avid, cid, qn)
 }
 
 func audioApiUrl(sid string) string {
@@ -228,6 +404,7 @@ func spaceFavlistApiUrl(fid string, pn int, ps int) string {
 	return fmt.Sprintf("https://api.bilibili.com/x/v3/fav/resource/list?media_id=%s&pn=%d&ps=%d&order=mtime&type=0&tid=0&jsonp=jsonp", fid, pn, ps)
 }
 
+// spaceVideoApi needs WBI signing, which is done by getContent.
 func spaceVideoApi(mid string, pn int, ps int) string {
 	if pn == 0 {
 		pn = 1
@@ -235,7 +412,7 @@ func spaceVideoApi(mid string, pn int, ps int) string {
 	if ps == 0 {
 		ps = 50
 	}
-	return fmt.Sprintf("https://api.bilibili.com/x/space/arc/search?mid=%s&pn=%d&ps=%d&tid=0&keyword=&order=pubdate&jsonp=jsonp", mid, pn, ps)
+	return fmt.Sprintf("https://api.bilibili.com/x/space/wbi/arc/search?mid=%s&pn=%d&ps=%d&tid=0&keyword=&order=pubdate", mid, pn, ps)
 }
 
 func vcApiUrl(videoid string) string {
@@ -246,8 +423,18 @@ func hApiUrl(docid string) string {
 	return fmt.Sprintf("https://api.vc.bilibili.com/link_draw/v1/doc/detail?doc_id=%s", docid)
 }
 
-// TODO create a cached and retry-able version
-func getContentLength(url string, header map[string]string) (int, error) {
+// getContentLength returns the size of the content at url, probed without
+// downloading it, see utils.ProbeContentLength. Sizes are cached per url for
+// the lifetime of the agent, failures for probeErrorTtl only, as they may be
+// transient.
+func (b *Bilibili) getContentLength(url string, header map[string]string) (int, error) {
+	b.sizesMu.Lock()
+	if size, ok := b.sizes[url]; ok && (size.err == nil || time.Since(size.probedAt) < probeErrorTtl) {
+		b.sizesMu.Unlock()
+		return size.size, size.err
+	}
+	b.sizesMu.Unlock()
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return 0, err
@@ -255,33 +442,121 @@ func getContentLength(url string, header map[string]string) (int, error) {
 	for k, v := range header {
 		req.Header.Add(k, v)
 	}
+	length, err := utils.ProbeContentLength(b.httpClient.Client(), req)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("GET request got error: %v", err)
+	b.sizesMu.Lock()
+	defer b.sizesMu.Unlock()
+	if b.sizes == nil {
+		b.sizes = make(map[string]probedSize)
 	}
-	defer resp.Body.Close()
+	b.sizes[url] = probedSize{size: int(length), err: err, probedAt: time.Now()}
+	return int(length), err
+}
+
+type probedSize struct {
+	size     int
+	err      error
+	probedAt time.Time
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("http status code is %d", resp.StatusCode)
+// how long a failed probe is not retried, long enough for the streams of a
+// video probed together to share the failure. A variable for tests.
+var probeErrorTtl = 30 * time.Second
+
+// the number of stream sizes probed at the same time
+const maxSizeProbes = 8
+
+// probeContentLengths fills the cache of getContentLength for urls,
+// probing them concurrently.
+func (b *Bilibili) probeContentLengths(urls []string, header map[string]string) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(maxSizeProbes, len(urls)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range jobs {
+				b.getContentLength(url, header)
+			}
+		}()
+	}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			jobs <- url
+		}
 	}
+	close(jobs)
+	wg.Wait()
+}
 
-	length, err := strconv.Atoi(resp.Header.Get("Content-Length"))
-	if err != nil {
-		return 0, fmt.Errorf(`response header "Content-Length" is not an integer`)
+// dashUrls returns the urls of the DASH representations of playInfos.
+func dashUrls(playInfos []*utils.JsonNode) []string {
+	urls := make([]string, 0)
+	for _, playinfo := range playInfos {
+		dash, err := playinfo.GetSubnode("data.dash")
+		if err != nil {
+			continue
+		}
+		for _, path := range []string{"video", "audio", "dolby.audio"} {
+			arr, _ := dash.GetArray(path)
+			for _, elem := range arr {
+				if u, err := utils.NewJsonNode(elem).GetString("baseUrl"); err == nil {
+					urls = append(urls, u)
+				}
+			}
+		}
+		if u, err := dash.GetString("flac.audio.baseUrl"); err == nil {
+			urls = append(urls, u)
+		}
 	}
-	return length, nil
+	return urls
 }
 
-// getContent send http GET request to URL and returns the replied content
+// signUrl adds the WBI signature to URLs of WBI APIs and returns other URLs
+// unchanged.
+func (b *Bilibili) signUrl(url string) (string, error) {
+	if !isWbiUrl(url) {
+		return url, nil
+	}
+	return b.wbi.sign(url, func() ([]byte, error) {
+		// the keys change, a cached response would keep the old ones
+		return b.httpClient.GetBodyNoCache(newRequest(navApiUrl(), b.getHeader("", "")))
+	})
+}
 
-// The http request is appended with bilibili headers
-func (b *Bilibili) getContent(url string, header map[string]string) ([]byte, error) {
+// newRequest creates a GET request with the given headers.
+func newRequest(url string, header map[string]string) *http.Request {
 	req, _ := http.NewRequest("GET", url, nil)
 	for k, v := range header {
 		req.Header.Add(k, v)
 	}
+	return req
+}
+
+// getContent send http GET request to URL and returns the replied content
 
+// The http request is appended with bilibili headers.
+// URLs of WBI APIs are signed before sending. As the signature carries the
+// time, signed URLs are never requested twice and bypass the cache.
+func (b *Bilibili) getContent(url string, header map[string]string) ([]byte, error) {
+	if isWbiUrl(url) {
+		url, err := b.signUrl(url)
+		if err != nil {
+			return nil, err
+		}
+		content, err := b.httpClient.GetBodyNoCache(newRequest(url, header))
+		if err == nil {
+			if j, err := utils.UnmarshalJson(content); err == nil {
+				if code, err := j.GetInt("code"); err == nil && isWbiRejected(code) {
+					b.wbi.invalidate()
+				}
+			}
+		}
+		return content, err
+	}
+	req := newRequest(url, header)
 	content, err := b.httpClient.GetBody(req)
 	if err != nil {
 		return nil, err
@@ -291,8 +566,14 @@ func (b *Bilibili) getContent(url string, header map[string]string) ([]byte, err
 
 // convert url of some specific format into regular video url
 func (b *Bilibili) prepare() ([]byte, error) {
-	// TODO: add user SESSDATA to cookies
-	htmlContent, err := b.getContent(b.Url, getHeader("", ""))
+	// short links and mobile urls
+	resolved, err := b.resolveUrl(b.Url)
+	if err != nil {
+		return nil, err
+	}
+	b.Url = resolved
+
+	htmlContent, err := b.getContent(b.Url, b.getHeader("", ""))
 	if err != nil {
 		htmlContent = nil
 	}
@@ -350,7 +631,7 @@ func (b *Bilibili) prepare() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	htmlContent, err = b.getContent(b.Url, getHeader(referer, ""))
+	htmlContent, err = b.getContent(b.Url, b.getHeader(referer, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -360,6 +641,20 @@ func (b *Bilibili) prepare() ([]byte, error) {
 
 func (b *Bilibili) getVideoInfo() ([]downloader.ResourceInfo, error) {
 
+	// expired cookies make the APIs silently return lower qualities
+	b.ensureCredential()
+
+	// feeds are read from their APIs only
+	resolved, err := b.resolveUrl(b.Url)
+	if err != nil {
+		return nil, err
+	}
+	if mid, ok := isDynamicsUrl(resolved); ok {
+		b.Url = resolved
+		b.vt = videoType_Not_Video
+		return b.getDynamics(mid)
+	}
+
 	// regulate url and get page content.
 	htmlContent, err := b.prepare()
 	if err != nil {
@@ -412,6 +707,11 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		Streams: make([]downloader.StreamInfo, 0),
 	}
 	var avid, cid int
+	if steinGate, _ := initialStateJson.GetInt("videoData.rights.is_stein_gate"); steinGate == 1 {
+		b.vt = videoType_Interactive
+		return b.getVideoInfoInteractive(initialStateJson)
+	}
+
 	if initialStateJson.HasField("videoData") {
 		// This is a regular video
 
@@ -451,6 +751,8 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		if err != nil {
 			// log
 		}
+		videoInfo.Metadata = getVideoMetadata(initialStateJson, p)
+		videoInfo.Id = videoCanonicalId(avid, fmt.Sprintf("p%d", p))
 
 		// initial state does not contain key "videoData"
 		// meaning it's a festival video
@@ -467,6 +769,15 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		if err != nil {
 			// log
 		}
+		videoInfo.Id = videoCanonicalId(avid, "p1")
+	}
+
+	// uploader season the video belongs to
+	if initialStateJson.HasField("videoData.ugc_season") {
+		videoInfo.Metadata.SeasonId, videoInfo.Metadata.Season = getUgcSeason(initialStateJson)
+		if _, ok := b.downloadParams["whole-season"]; ok {
+			return b.getUgcSeasonEpisodes(initialStateJson)
+		}
 	}
 
 	// Video Quality variations
@@ -483,7 +794,7 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 			playInfoJson1 = nil
 		}
 	}
-	htmlContent2, err := b.getContent(b.Url, getHeader("", "CURRENT_FNVAL=16"))
+	htmlContent2, err := b.getContent(b.Url, b.getHeader("", "CURRENT_FNVAL=16"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get html content: %v", err)
 	}
@@ -528,7 +839,7 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		// for dash, qn does not matter
 		if currentQuality == -1 || qn < currentQuality {
 			apiUrlStr := apiUrl(strconv.Itoa(avid), strconv.Itoa(cid), qn)
-			apiContent, err := b.getContent(apiUrlStr, getHeader(b.Url, ""))
+			apiContent, err := b.getContent(apiUrlStr, b.getHeader(b.Url, ""))
 			if err != nil {
 				return nil, fmt.Errorf("failed to get response from api url: %v", err)
 			}
@@ -547,7 +858,7 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		}
 		if bestQuality == -1 || qn < bestQuality {
 			interfaceApiUrlString := interfaceApiUrl(strconv.Itoa(cid), qn)
-			interfaceApiContent, err := b.getContent(interfaceApiUrlString, getHeader(b.Url, ""))
+			interfaceApiContent, err := b.getContent(interfaceApiUrlString, b.getHeader(b.Url, ""))
 			if err != nil {
 				return nil, fmt.Errorf("failed to get response from interface url: %v", err)
 			}
@@ -569,11 +880,57 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		return nil, fmt.Errorf("got 0 video info.")
 	}
 
+	videoInfo.Streams, videoInfo.AudioStreams, err = b.parsePlayInfos(playInfos)
+	if err != nil {
+		return nil, err
+	}
+
+	// get danmaku
+	/*
+		hd=self.bilibili_headers()
+		hd['If-Modified-Since']='Wed, 15 May 2024 01:01:24 GMT'
+		self.danmaku = get_content('https://comment.bilibili.com/%s.xml' % cid, headers=hd)
+	*/
+
+	b.infoAcquired = true
+	b.resourceInfos = []downloader.ResourceInfo{videoInfo}
+	return b.resourceInfos, nil
+}
+
+// resolveStreams fills the streams of a resource found in a list, identified
+// by the "avid" and "cid" entries of info.Others, using the playurl API.
+func (b *Bilibili) resolveStreams(info *downloader.ResourceInfo) error {
+	apiContent, err := b.getContent(apiUrl(info.Others["avid"], info.Others["cid"], 120), b.getHeader(b.Url, ""))
+	if err != nil {
+		return fmt.Errorf("failed to get response from api url: %v", err)
+	}
+	playInfo, err := utils.UnmarshalJson(apiContent)
+	if err != nil {
+		return fmt.Errorf("failed to parse response from api url as json data: %v", err)
+	}
+	if code, err := playInfo.GetInt("code"); err != nil || code != 0 {
+		message, _ := playInfo.GetString("message")
+		return fmt.Errorf("playurl api returned code %d: %s", code, message)
+	}
+	info.Streams, info.AudioStreams, err = b.parsePlayInfos([]*utils.JsonNode{playInfo})
+	return err
+}
+
+// parsePlayInfos turns playinfo responses into video and audio streams. Every
+// DASH representation becomes its own stream, so the same quality encoded with
+// different codecs yields one stream per codec. Video streams of DASH formats
+// come with a default audio track as their second url; the audio streams can
+// be used to replace it. Both results are sorted from the best stream to the
+// worst.
+func (b *Bilibili) parsePlayInfos(playInfos []*utils.JsonNode) ([]downloader.StreamInfo, []downloader.StreamInfo, error) {
 	videoInfoMap := make(map[string]downloader.StreamInfo)
+	audioInfoMap := make(map[string]downloader.StreamInfo)
+	// the sizes are looked up from the cache below
+	b.probeContentLengths(dashUrls(playInfos), b.getHeader(b.Url, ""))
 	for _, playinfo := range playInfos {
 		quality, err := playinfo.GetInt("data.quality")
 		if err != nil {
-			return nil, fmt.Errorf("ill-formated playinfo json data: %v", err)
+			return nil, nil, fmt.Errorf("ill-formated playinfo json data: %v", err)
 		}
 		st := streamTypes[quality]
 		formatId := st.Id
@@ -589,6 +946,7 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 		}
 		if len(durlArr) > 0 {
 			srcs := make([]string, 0)
+			backups := make([][]string, 0)
 			sizes := 0
 			for _, elem := range durlArr {
 				durlJson := utils.NewJsonNode(elem)
@@ -601,20 +959,22 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 					// log
 				}
 				srcs = append(srcs, src)
+				backups = append(backups, backupUrls(durlJson))
 				sizes += size
 
 			}
 			videoInfoMap[formatId] = downloader.StreamInfo{
 				Id:           formatId,
 				Container:    container,
+				Resolution:   [2]int{0, resolutionHeight(st.VideoResolution)},
 				Size:         sizes,
 				Url:          srcs,
+				BackupUrl:    backups,
 				Others:       map[string]string{"Quality": desc},
 				DownloadWith: fmt.Sprintf("--format=%s", formatId)}
 		}
 
 		if dash, err := playinfo.GetSubnode("data.dash"); err == nil {
-			audioSizeCache := make(map[int]int)
 			videoArr, err := dash.GetArray("video")
 			if err != nil {
 				// log
@@ -631,7 +991,10 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 					// log
 					continue
 				}
-				formatId := "dash-" + st.Id
+				codecs, _ := video.GetString("codecs")
+				codecId, _ := video.GetInt("codecid")
+				codec := codecName(codecId, codecs)
+				formatId := fmt.Sprintf("dash-%s-%s", st.Id, codec)
 				if _, ok := videoInfoMap[formatId]; ok {
 					continue
 				}
@@ -643,9 +1006,26 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 					// log
 					baseurl = ""
 				}
-				size, err := getContentLength(baseurl, getHeader(b.Url, ""))
+				size, err := b.getContentLength(baseurl, b.getHeader(b.Url, ""))
 				if err != nil {
-					return nil, fmt.Errorf("failed to get content length from url %s: %v", baseurl, err)
+					return nil, nil, fmt.Errorf("failed to get content length from url %s: %v", baseurl, err)
+				}
+
+				stream := downloader.StreamInfo{
+					Id:           formatId,
+					Codec:        codec,
+					Container:    container,
+					Url:          []string{baseurl},
+					BackupUrl:    [][]string{backupUrls(video)},
+					Size:         size,
+					DownloadWith: fmt.Sprintf("--format=%s", formatId),
+					Others:       map[string]string{"Quality": desc, "Codecs": codecs},
+				}
+				stream.Resolution[0], _ = video.GetInt("width")
+				stream.Resolution[1], _ = video.GetInt("height")
+				stream.Bandwidth, _ = video.GetInt("bandwidth")
+				if frameRate, err := video.GetString("frameRate"); err == nil {
+					stream.FrameRate, _ = strconv.ParseFloat(frameRate, 64)
 				}
 
 				// find matching audio track
@@ -654,16 +1034,19 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 					// log
 				} else if len(audioArr) > 0 {
 					var audioBaseUrl string
+					var audioBackupUrls []string
 					for _, elem := range audioArr {
 						audio := utils.NewJsonNode(elem)
 						if audioId, err := audio.GetInt("id"); err == nil {
 							if baseUrlTmp, err := audio.GetString("baseUrl"); err == nil {
 								if audioId == audioQuality {
 									audioBaseUrl = baseUrlTmp
+									audioBackupUrls = backupUrls(audio)
 									break
 								}
 								if audioBaseUrl == "" {
 									audioBaseUrl = baseUrlTmp
+									audioBackupUrls = backupUrls(audio)
 								}
 							} else {
 								// log
@@ -672,34 +1055,43 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 							// log
 						}
 					}
-					if audioBaseUrl != "" {
-						if _, ok := audioSizeCache[audioQuality]; !ok {
-							audioSizeCache[audioQuality], err = getContentLength(audioBaseUrl, getHeader(b.Url, ""))
-							if err != nil {
-								return nil, fmt.Errorf("failed to get Content-Length for audio from url %s: %v", audioBaseUrl, err)
-							}
-						}
-						size += audioSizeCache[audioQuality]
-
-						videoInfoMap[formatId] = downloader.StreamInfo{
-							Id:           formatId,
-							Container:    container,
-							Url:          []string{baseurl, audioBaseUrl},
-							Size:         size,
-							DownloadWith: fmt.Sprintf("--format=%s", formatId),
-							Others:       map[string]string{"Quality": desc},
-						}
+					if audioBaseUrl == "" {
+						continue
+					}
+					audioSize, err := b.getContentLength(audioBaseUrl, b.getHeader(b.Url, ""))
+					if err != nil {
+						return nil, nil, fmt.Errorf("failed to get Content-Length for audio from url %s: %v", audioBaseUrl, err)
 					}
+					stream.Size += audioSize
+					stream.Url = append(stream.Url, audioBaseUrl)
+					stream.BackupUrl = append(stream.BackupUrl, audioBackupUrls)
+				}
+				videoInfoMap[formatId] = stream
+			}
 
-				} else { //no audio info
-					videoInfoMap[formatId] = downloader.StreamInfo{
-						Id:           formatId,
-						Container:    container,
-						Url:          []string{baseurl},
-						Size:         size,
-						DownloadWith: fmt.Sprintf("--format=%s", formatId),
-						Others:       map[string]string{"Quality": desc},
+			// audio tracks, including Dolby Atmos and Hi-Res lossless ones
+			audioNodes := make([]*utils.JsonNode, 0)
+			for _, path := range []string{"audio", "dolby.audio", "flac.audio"} {
+				if arr, err := dash.GetArray(path); err == nil {
+					for _, elem := range arr {
+						audioNodes = append(audioNodes, utils.NewJsonNode(elem))
 					}
+				} else if _, err := dash.GetMap(path); err == nil {
+					// "flac.audio" is a single object
+					node, _ := dash.GetSubnode(path)
+					audioNodes = append(audioNodes, node)
+				}
+			}
+			for _, audio := range audioNodes {
+				stream, err := b.parseDashAudio(audio)
+				if err != nil {
+					return nil, nil, err
+				}
+				if stream == nil {
+					continue
+				}
+				if _, ok := audioInfoMap[stream.Id]; !ok {
+					audioInfoMap[stream.Id] = *stream
 				}
 			}
 
@@ -708,27 +1100,161 @@ func (b *Bilibili) getRegularVideoInfo(htmlContent []byte) ([]downloader.Resourc
 			// log
 		}
 	}
+
+	streams := make([]downloader.StreamInfo, 0, len(videoInfoMap))
 	for _, v := range videoInfoMap {
-		videoInfo.Streams = append(videoInfo.Streams, v)
+		streams = append(streams, v)
+	}
+	audioStreams := make([]downloader.StreamInfo, 0, len(audioInfoMap))
+	for _, v := range audioInfoMap {
+		audioStreams = append(audioStreams, v)
+	}
+	slices.SortFunc(audioStreams, func(a, b downloader.StreamInfo) int {
+		if a.Bandwidth != b.Bandwidth {
+			return b.Bandwidth - a.Bandwidth
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	slices.SortFunc(streams, func(a, b downloader.StreamInfo) int {
+		if a.Resolution[1] != b.Resolution[1] {
+			return b.Resolution[1] - a.Resolution[1]
+		}
+		if a.FrameRate != b.FrameRate {
+			return cmp.Compare(b.FrameRate, a.FrameRate)
+		}
+		if a.Bandwidth != b.Bandwidth {
+			return b.Bandwidth - a.Bandwidth
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	return streams, audioStreams, nil
+}
+
+// parseDashAudio converts a DASH audio representation into an audio stream.
+// It returns nil if the representation does not have an url.
+func (b *Bilibili) parseDashAudio(audio *utils.JsonNode) (*downloader.StreamInfo, error) {
+	id, err := audio.GetInt("id")
+	if err != nil {
+		// log
+		return nil, nil
+	}
+	baseurl, err := audio.GetString("baseUrl")
+	if err != nil || baseurl == "" {
+		// log
+		return nil, nil
+	}
+	at, ok := audioStreamTypes[id]
+	if !ok {
+		at = audiostreamtype{Id: fmt.Sprintf("audio-%d", id), Desc: strconv.Itoa(id)}
 	}
+	size, err := b.getContentLength(baseurl, b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Content-Length for audio from url %s: %v", baseurl, err)
+	}
+	codecs, _ := audio.GetString("codecs")
+	stream := &downloader.StreamInfo{
+		Id:           at.Id,
+		Codec:        audioCodecName(codecs),
+		Container:    "mp4",
+		Url:          []string{baseurl},
+		BackupUrl:    [][]string{backupUrls(audio)},
+		Size:         size,
+		DownloadWith: fmt.Sprintf("--audio=%s", at.Id),
+		Others:       map[string]string{"Quality": at.Desc, "Codecs": codecs},
+	}
+	stream.Bandwidth, _ = audio.GetInt("bandwidth")
+	return stream, nil
+}
 
-	// get danmaku
-	/*
-		hd=self.bilibili_headers()
-		hd['If-Modified-Since']='Wed, 15 May 2024 01:01:24 GMT'
-		self.danmaku = get_content('https://comment.bilibili.com/%s.xml' % cid, headers=hd)
-	*/
+// backupUrls returns the mirrors of a DASH representation or a durl entry,
+// which are named "backupUrl" or "backup_url" depending on the API.
+func backupUrls(node *utils.JsonNode) []string {
+	urls := make([]string, 0)
+	for _, path := range []string{"backupUrl", "backup_url"} {
+		arr, err := node.GetArray(path)
+		if err != nil {
+			continue
+		}
+		for _, elem := range arr {
+			if u, ok := elem.(string); ok && u != "" && !slices.Contains(urls, u) {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
 
-	b.infoAcquired = true
-	b.resourceInfos = []downloader.ResourceInfo{videoInfo}
-	return b.resourceInfos, nil
+// audioCodecName maps the RFC 6381 codecs string of an audio track to a short name.
+func audioCodecName(codecs string) string {
+	switch {
+	case strings.HasPrefix(codecs, "mp4a"):
+		return "aac"
+	case strings.HasPrefix(codecs, "ec-3"):
+		return "eac3"
+	case strings.EqualFold(codecs, "flac"):
+		return "flac"
+	}
+	return codecs
 }
 
-func (b *Bilibili) getVideoInfoBangumi(htmlContent []byte) ([]downloader.ResourceInfo, error) {
-	return nil, downloader.ErrUnimplemented
+// codecName maps the codec id of a DASH representation to a short name. The
+// RFC 6381 codecs string is used when the id is unknown.
+func codecName(codecId int, codecs string) string {
+	switch {
+	case codecId == 7 || strings.HasPrefix(codecs, "avc"):
+		return "avc"
+	case codecId == 12 || strings.HasPrefix(codecs, "hev") || strings.HasPrefix(codecs, "hvc"):
+		return "hevc"
+	case codecId == 13 || strings.HasPrefix(codecs, "av01"):
+		return "av1"
+	case codecs != "":
+		return strings.SplitN(codecs, ".", 2)[0]
+	}
+	return "unknown"
+}
+
+// resolutionHeight converts resolutions like "1080p" to the height in pixels.
+func resolutionHeight(resolution string) int {
+	height, _ := strconv.Atoi(strings.TrimSuffix(resolution, "p"))
+	return height
+}
+
+// getVideoMetadata collects uploader, statistics and other descriptive fields
+// of part p from the initial state of a regular video page.
+func getVideoMetadata(initialState *utils.JsonNode, p int) downloader.Metadata {
+	var meta downloader.Metadata
+	meta.Uploader, _ = initialState.GetString("videoData.owner.name")
+	if mid, err := initialState.GetInt("videoData.owner.mid"); err == nil {
+		meta.UploaderId = strconv.Itoa(mid)
+	}
+	if pubdate, err := initialState.GetInt("videoData.pubdate"); err == nil {
+		meta.PublishTime = time.Unix(int64(pubdate), 0)
+	}
+	duration, err := initialState.GetInt(fmt.Sprintf("videoData.pages.[%d].duration", p-1))
+	if err != nil {
+		duration, _ = initialState.GetInt("videoData.duration")
+	}
+	meta.Duration = time.Duration(duration) * time.Second
+	meta.Description, _ = initialState.GetString("videoData.desc")
+	meta.Cover, _ = initialState.GetString("videoData.pic")
+	meta.Views, _ = initialState.GetInt("videoData.stat.view")
+	meta.Likes, _ = initialState.GetInt("videoData.stat.like")
+	meta.Coins, _ = initialState.GetInt("videoData.stat.coin")
+	meta.Favorites, _ = initialState.GetInt("videoData.stat.favorite")
+	meta.Danmakus, _ = initialState.GetInt("videoData.stat.danmaku")
+	meta.Comments, _ = initialState.GetInt("videoData.stat.reply")
+	meta.Shares, _ = initialState.GetInt("videoData.stat.share")
+
+	tags, _ := initialState.GetArray("tags")
+	for _, elem := range tags {
+		if name, err := utils.NewJsonNode(elem).GetString("tag_name"); err == nil {
+			meta.Tags = append(meta.Tags, name)
+		}
+	}
+	return meta
 }
 
-func (b *Bilibili) getVideoInfoLive(htmlContent []byte) ([]downloader.ResourceInfo, error) {
+func (b *Bilibili) getVideoInfoBangumi(htmlContent []byte) ([]downloader.ResourceInfo, error) {
 	return nil, downloader.ErrUnimplemented
 }
 
@@ -743,13 +1269,22 @@ func (b *Bilibili) getVideoInfoVC(htmlContent []byte) ([]downloader.ResourceInfo
 
 func (*Bilibili) CanHandle(url string) bool {
 	matched, _ := regexp.MatchString(`(https?://)?(www\.)?bilibili\.com/`, url)
-	return matched
+	return matched || shortLinkRegex.MatchString(url)
 }
 
 func (b *Bilibili) GetResourceInfo() ([]downloader.ResourceInfo, error) {
+	if b.infoAcquired {
+		return b.resourceInfos, nil
+	}
 	return b.getVideoInfo()
 }
 
+func (b *Bilibili) SetParams(params downloader.Params) {
+	for k, v := range params {
+		b.downloadParams[k] = v
+	}
+}
+
 func (b *Bilibili) Download(index int, path string) chan *downloader.Progress {
 	progress := make(chan *downloader.Progress)
 	go func() {
@@ -761,13 +1296,259 @@ func (b *Bilibili) Download(index int, path string) chan *downloader.Progress {
 				progress <- &downloader.Progress{Status: "", Percentage: 1, Err: fmt.Errorf("failed to get video information: %v", err)}
 				return
 			}
+		}
+		if index < 0 || index >= len(b.resourceInfos) {
+			progress <- &downloader.Progress{Status: "", Percentage: 1, Err: fmt.Errorf("resource index %d out of range", index)}
+			return
+		}
 
-			progress <- &downloader.Progress{Status: "Done. ", Percentage: 1}
+		if b.vt == videoType_Interactive {
+			if err := b.saveInteractiveGraph(path); err != nil {
+				progress <- &downloader.Progress{Status: "", Percentage: 1, Err: err}
+				return
+			}
+		}
+
+		status, err := b.downloadVideo(&b.resourceInfos[index], path, progress)
+		if err != nil {
+			progress <- &downloader.Progress{Status: "", Percentage: 1, Err: err}
+			return
 		}
+		progress <- &downloader.Progress{Status: status, Percentage: 1}
 	}()
 	return progress
 }
 
-func (b *Bilibili) DownloadAll(path string) (chan byte, error) {
-	return nil, downloader.ErrUnimplemented
+// DownloadAll downloads every resource into path. Progress of the single
+// downloads is scaled to the whole list.
+func (b *Bilibili) DownloadAll(path string) chan *downloader.Progress {
+	progress := make(chan *downloader.Progress)
+	go func() {
+		defer close(progress)
+		if !b.infoAcquired {
+			progress <- &downloader.Progress{Status: "Getting video information.", Percentage: 0}
+			_, err := b.getVideoInfo()
+			if err != nil {
+				progress <- &downloader.Progress{Status: "", Percentage: 1, Err: fmt.Errorf("failed to get video information: %v", err)}
+				return
+			}
+		}
+
+		if b.vt == videoType_Interactive {
+			if err := b.saveInteractiveGraph(path); err != nil {
+				progress <- &downloader.Progress{Status: "", Percentage: 1, Err: err}
+				return
+			}
+		}
+
+		n := len(b.resourceInfos)
+		for i := range b.resourceInfos {
+			single := make(chan *downloader.Progress)
+			var err error
+			go func() {
+				defer close(single)
+				_, err = b.downloadVideo(&b.resourceInfos[i], path, single)
+			}()
+			for p := range single {
+				progress <- &downloader.Progress{
+					Status:     fmt.Sprintf("[%d/%d] %s", i+1, n, p.Status),
+					Percentage: (float32(i) + p.Percentage) / float32(n),
+				}
+			}
+			if err != nil {
+				progress <- &downloader.Progress{Status: "", Percentage: 1, Err: fmt.Errorf("failed to download %s: %v", b.resourceInfos[i].Name, err)}
+				return
+			}
+		}
+		progress <- &downloader.Progress{Status: "Done.", Percentage: 1}
+	}()
+	return progress
+}
+
+// fileBaseName names the files of a resource after its title and canonical
+// id, e.g. "Title [BV17x411w7KC_p1]".
+func fileBaseName(info *downloader.ResourceInfo) string {
+	name := info.Name
+	if parts := strings.SplitN(info.Id, ":", 3); len(parts) == 3 {
+		name += " [" + strings.ReplaceAll(parts[2], ":", "_") + "]"
+	}
+	return utils.SanitizeFilename(name)
+}
+
+// selectStreams picks the video stream and the audio stream to download.
+// The "format" parameter selects the video stream, otherwise the best stream
+// accepted by the stream filter parameters is used. The "audio" parameter
+// replaces the default audio track of a DASH stream; audio is nil if the
+// default is kept.
+func (b *Bilibili) selectStreams(info *downloader.ResourceInfo) (video *downloader.StreamInfo, audio *downloader.StreamInfo, err error) {
+	if format, ok := b.downloadParams["format"]; ok {
+		for i := range info.Streams {
+			if info.Streams[i].Id == format {
+				video = &info.Streams[i]
+				break
+			}
+		}
+		if video == nil {
+			return nil, nil, fmt.Errorf("format %s is not available", format)
+		}
+	} else {
+		filter, err := downloader.NewStreamFilter(b.downloadParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		streams := filter.Filter(info.Streams)
+		if len(streams) == 0 {
+			return nil, nil, fmt.Errorf("no stream matches the given filters")
+		}
+		video = &streams[0]
+	}
+
+	if id, ok := b.downloadParams["audio"]; ok {
+		if !strings.HasPrefix(video.Id, "dash-") {
+			return nil, nil, fmt.Errorf("format %s has no separate audio track to replace", video.Id)
+		}
+		for i := range info.AudioStreams {
+			if info.AudioStreams[i].Id == id {
+				audio = &info.AudioStreams[i]
+				break
+			}
+		}
+		if audio == nil {
+			return nil, nil, fmt.Errorf("audio %s is not available", id)
+		}
+	}
+	return video, audio, nil
+}
+
+// downloadVideo downloads the selected streams of info into directory dir and
+// merges them into one file. It returns the final status to report.
+func (b *Bilibili) downloadVideo(info *downloader.ResourceInfo, dir string, progress chan *downloader.Progress) (string, error) {
+	if b.vt == videoType_Live {
+		return b.recordLive(info, dir, progress)
+	}
+	if info.Type == downloader.RT_Image || info.Type == downloader.RT_Text {
+		return b.downloadPost(info, dir, progress)
+	}
+	if len(info.Streams) == 0 && info.Others["avid"] != "" {
+		progress <- &downloader.Progress{Status: "Getting stream information.", Percentage: 0}
+		if info.Others["cid"] == "" {
+			if err := b.resolveCid(info); err != nil {
+				return "", err
+			}
+		}
+		if err := b.resolveStreams(info); err != nil {
+			return "", err
+		}
+	}
+	video, audio, err := b.selectStreams(info)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		dir = "."
+	}
+	base := filepath.Join(dir, fileBaseName(info))
+
+	isDash := strings.HasPrefix(video.Id, "dash-")
+	total := video.Size
+	var files []string
+	// every file is downloaded from its url or one of the mirrors
+	var urls [][]string
+	var output string
+	if isDash {
+		urls = append(urls, video.Mirrors(0))
+		files = append(files, base+".video.m4s")
+		var audioUrls []string
+		audioUrl := ""
+		if len(video.Url) > 1 {
+			audioUrls = video.Mirrors(1)
+			audioUrl = video.Url[1]
+		}
+		output = base + ".mp4"
+		if audio != nil {
+			for _, a := range info.AudioStreams {
+				if len(a.Url) > 0 && a.Url[0] == audioUrl {
+					total -= a.Size
+				}
+			}
+			total += audio.Size
+			audioUrls = audio.Mirrors(0)
+			if audio.Codec == "flac" {
+				output = base + ".mkv"
+			}
+		}
+		if len(audioUrls) > 0 {
+			urls = append(urls, audioUrls)
+			files = append(files, base+".audio.m4s")
+		}
+	} else {
+		ext := "." + strings.ToLower(video.Container)
+		output = base + ext
+		for i := range video.Url {
+			urls = append(urls, video.Mirrors(i))
+		}
+		if len(urls) == 1 {
+			files = []string{output}
+		} else {
+			for i := range urls {
+				files = append(files, fmt.Sprintf("%s.part%d%s", base, i+1, ext))
+			}
+		}
+	}
+
+	// download
+	finished := int64(0)
+	lastReport := time.Time{}
+	for i, mirrors := range urls {
+		status := fmt.Sprintf("Downloading %s (%d/%d)", filepath.Base(files[i]), i+1, len(urls))
+		reqs := make([]*http.Request, 0, len(mirrors))
+		for _, u := range mirrors {
+			req, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				return "", err
+			}
+			for k, v := range b.getHeader(b.Url, "") {
+				req.Header.Set(k, v)
+			}
+			reqs = append(reqs, req)
+		}
+		err = utils.DownloadFileMirrors(b.httpClient.StreamClient(), reqs, files[i], func(written int64) {
+			if time.Since(lastReport) < 100*time.Millisecond {
+				return
+			}
+			lastReport = time.Now()
+			var percentage float32
+			if total > 0 {
+				percentage = min(float32(finished+written)/float32(total), 0.99)
+			}
+			progress <- &downloader.Progress{Status: status, Percentage: percentage}
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to download %s: %v", mirrors[0], err)
+		}
+		if stat, err := os.Stat(files[i]); err == nil {
+			finished += stat.Size()
+		}
+	}
+	if len(files) == 1 && files[0] == output {
+		return "Done.", nil
+	}
+
+	// merge
+	if !utils.FfmpegAvailable() {
+		return "Done. ffmpeg not found, tracks are saved separately.", nil
+	}
+	progress <- &downloader.Progress{Status: "Merging with ffmpeg", Percentage: 0.99}
+	if isDash {
+		err = utils.MergeTracks(output, files...)
+	} else {
+		err = utils.ConcatSegments(output, files)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		os.Remove(f)
+	}
+	return "Done.", nil
 }
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"internal/utils"
+)
+
+// premiumQualities are the qualities worth reporting for an account, from
+// the lowest to the highest. Lower ones are available to everyone.
+var premiumQualities = []int{80, 112, 116, 120, 125, 126, 127}
+
+// qualityProbeApiUrl asks for every format the account can get, including
+// HDR, 4K, Dolby Vision and 8K.
+func qualityProbeApiUrl(avid string, cid string) string {
+	return fmt.Sprintf("https://api.bilibili.com/x/player/wbi/playurl?avid=%s&cid=%s&qn=127&fnver=0&fnval=4048&fourk=1", avid, cid)
+}
+
+// BilibiliAccount describes the user the credentials of the agent belong to.
+type BilibiliAccount struct {
+	LoggedIn  bool
+	Uid       int
+	Name      string
+	Level     int
+	VipType   int // 0: none, 1: monthly, 2: annual
+	VipActive bool
+	VipLabel  string
+	VipExpiry time.Time
+
+	// Qualities maps the qualities of premiumQualities to whether they can be
+	// obtained for the sample video. It is nil if no sample video is given.
+	Qualities map[int]bool
+}
+
+// QualityDesc returns the description of a quality, e.g. "超清 4K".
+func QualityDesc(quality int) string {
+	return streamTypes[quality].Desc
+}
+
+// PremiumQualities returns the qualities reported in BilibiliAccount.Qualities,
+// from the lowest to the highest.
+func PremiumQualities() []int {
+	return premiumQualities
+}
+
+// WhoAmI reports the account of the agent's credentials. If the agent has a
+// video url, the qualities obtainable for that video are probed as well.
+func (b *Bilibili) WhoAmI() (*BilibiliAccount, error) {
+	navJson, err := b.getJsonUncached(navApiUrl(), b.getHeader("", ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account information: %v", err)
+	}
+	account := &BilibiliAccount{}
+	account.LoggedIn, _ = navJson.GetBool("data.isLogin")
+	if account.LoggedIn {
+		account.Uid, _ = navJson.GetInt("data.mid")
+		account.Name, _ = navJson.GetString("data.uname")
+		account.Level, _ = navJson.GetInt("data.level_info.current_level")
+		account.VipType, _ = navJson.GetInt("data.vipType")
+		vipStatus, _ := navJson.GetInt("data.vipStatus")
+		account.VipActive = vipStatus == 1
+		account.VipLabel, _ = navJson.GetString("data.vip_label.text")
+		if due, err := navJson.GetInt("data.vipDueDate"); err == nil && due > 0 {
+			account.VipExpiry = time.UnixMilli(int64(due))
+		}
+	}
+
+	if b.Url == "" {
+		return account, nil
+	}
+	account.Qualities, err = b.probeQualities()
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// probeQualities finds out which of premiumQualities the playurl API returns
+// for the video of the agent.
+func (b *Bilibili) probeQualities() (map[int]bool, error) {
+	htmlContent, err := b.prepare()
+	if err != nil {
+		return nil, err
+	}
+	initialStateRegex := regexp.MustCompile(`__INITIAL_STATE__=(.*?);\(function\(\)`)
+	match := initialStateRegex.FindSubmatch(htmlContent)
+	if match == nil {
+		return nil, fmt.Errorf("the sample url is not a regular video page")
+	}
+	initialState, err := utils.UnmarshalJson(match[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse initial state as json: %v", err)
+	}
+	avid, err := initialState.GetInt("videoData.aid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get avid of the sample video: %v", err)
+	}
+	cid, err := initialState.GetInt("videoData.cid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cid of the sample video: %v", err)
+	}
+
+	playInfo, err := b.getJsonUncached(qualityProbeApiUrl(strconv.Itoa(avid), strconv.Itoa(cid)), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get play info of the sample video: %v", err)
+	}
+	obtained := make(map[int]bool)
+	videos, _ := playInfo.GetArray("data.dash.video")
+	for _, elem := range videos {
+		if id, err := utils.NewJsonNode(elem).GetInt("id"); err == nil {
+			obtained[id] = true
+		}
+	}
+	if quality, err := playInfo.GetInt("data.quality"); err == nil {
+		obtained[quality] = true
+	}
+
+	// qualities the video does not offer at all are left out
+	offered := make(map[int]bool)
+	accepted, _ := playInfo.GetArray("data.accept_quality")
+	for _, elem := range accepted {
+		if q, ok := elem.(float64); ok {
+			offered[int(q)] = true
+		}
+	}
+	qualities := make(map[int]bool)
+	for _, q := range premiumQualities {
+		if offered[q] {
+			qualities[q] = obtained[q]
+		}
+	}
+	return qualities, nil
+}
@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"internal/utils"
+
+	"downloader"
+)
+
+// Dynamics, the posts of the users followed and of a single user, see
+// https://github.com/SocialSisterYi/bilibili-API-collect/blob/master/docs/dynamic/all.md
+
+// the following feed of the logged-in user
+func dynamicsFeedApiUrl(offset string) string {
+	return fmt.Sprintf("https://api.bilibili.com/x/polymer/web-dynamic/v1/feed/all?type=all&offset=%s&features=itemOpusStyle", offset)
+}
+
+// the dynamics posted by user mid
+func dynamicsSpaceApiUrl(mid string, offset string) string {
+	return fmt.Sprintf("https://api.bilibili.com/x/polymer/web-dynamic/v1/feed/space?host_mid=%s&offset=%s&features=itemOpusStyle", mid, offset)
+}
+
+func pageListApiUrl(avid string) string {
+	return fmt.Sprintf("https://api.bilibili.com/x/player/pagelist?aid=%s", avid)
+}
+
+// paging stops here if no "since" parameter limits the feed
+const maxDynamicsPages = 20
+
+var (
+	dynamicsFeedRegex  = regexp.MustCompile(`^https?://t\.bilibili\.com/?(\?.*)?$`)
+	dynamicsSpaceRegex = regexp.MustCompile(`^https?://space\.bilibili\.com/(\d+)/dynamic`)
+)
+
+// isDynamicsUrl tells whether rawUrl is a feed of dynamics. mid is the user
+// whose dynamics it lists, "" for the following feed.
+func isDynamicsUrl(rawUrl string) (mid string, ok bool) {
+	if dynamicsFeedRegex.MatchString(rawUrl) {
+		return "", true
+	}
+	if match := dynamicsSpaceRegex.FindStringSubmatch(rawUrl); match != nil {
+		return match[1], true
+	}
+	return "", false
+}
+
+// parseSince parses the "since" parameter, which is either a time like
+// "2024-05-01", "2024-05-01T08:00:00+08:00" or a unix timestamp, or a
+// duration back from now like "36h" or "7d".
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expect a date, a unix timestamp or a duration like 24h or 7d", s)
+}
+
+// getDynamics lists the videos, image posts and text posts of a feed from
+// the newest to the oldest, down to the "since" parameter if given.
+func (b *Bilibili) getDynamics(mid string) ([]downloader.ResourceInfo, error) {
+	var since time.Time
+	if s, ok := b.downloadParams["since"]; ok {
+		var err error
+		since, err = parseSince(s, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resources := make([]downloader.ResourceInfo, 0)
+	offset := ""
+	for page := 0; !since.IsZero() || page < maxDynamicsPages; page++ {
+		apiUrl := dynamicsFeedApiUrl(offset)
+		if mid != "" {
+			apiUrl = dynamicsSpaceApiUrl(mid, offset)
+		}
+		// feeds keep changing, they do not go through the cache
+		feedJson, err := b.getJsonUncached(apiUrl, b.getHeader(b.Url, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get dynamics: %v", err)
+		}
+		code, _ := feedJson.GetInt("code")
+		if code == -101 {
+			return nil, fmt.Errorf("%w: the dynamics feed needs a login", downloader.ErrCredentialInvalid)
+		}
+		if code != 0 {
+			message, _ := feedJson.GetString("message")
+			return nil, fmt.Errorf("dynamics api returned code %d: %s", code, message)
+		}
+
+		items, _ := feedJson.GetArray("data.items")
+		reachedSince := false
+		for _, elem := range items {
+			item := utils.NewJsonNode(elem)
+			info, published, ok := parseDynamicItem(item)
+			if !since.IsZero() && published.Before(since) {
+				// pinned items are older than the ones after them
+				if tag, _ := item.GetString("modules.module_tag.text"); tag != "置顶" {
+					reachedSince = true
+					break
+				}
+				continue
+			}
+			if ok {
+				resources = append(resources, info)
+			}
+		}
+
+		hasMore, _ := feedJson.GetBool("data.has_more")
+		offset, _ = feedJson.GetString("data.offset")
+		if reachedSince || !hasMore || offset == "" {
+			break
+		}
+	}
+
+	b.infoAcquired = true
+	b.resourceInfos = downloader.Dedup(resources)
+	return b.resourceInfos, nil
+}
+
+// jsonId reads an id the APIs give either as number or as string.
+func jsonId(node *utils.JsonNode, path string) string {
+	if s, err := node.GetString(path); err == nil {
+		return s
+	}
+	if i, err := node.GetInt(path); err == nil {
+		return strconv.Itoa(i)
+	}
+	return ""
+}
+
+// parseDynamicItem turns an item of a feed into a resource. Forwarded items
+// resolve to what they forward. ok is false for items that have nothing to
+// download, e.g. live room recommendations or deleted posts.
+func parseDynamicItem(item *utils.JsonNode) (info downloader.ResourceInfo, published time.Time, ok bool) {
+	if ts, err := item.GetInt("modules.module_author.pub_ts"); err == nil {
+		published = time.Unix(int64(ts), 0)
+	}
+	content := item
+	if t, _ := item.GetString("type"); t == "DYNAMIC_TYPE_FORWARD" {
+		orig, err := item.GetSubnode("orig")
+		if err != nil {
+			return info, published, false
+		}
+		content = orig
+	}
+	id := jsonId(content, "id_str")
+	if id == "" {
+		return info, published, false
+	}
+
+	meta := downloader.Metadata{}
+	meta.Uploader, _ = content.GetString("modules.module_author.name")
+	meta.UploaderId = jsonId(content, "modules.module_author.mid")
+	if ts, err := content.GetInt("modules.module_author.pub_ts"); err == nil {
+		meta.PublishTime = time.Unix(int64(ts), 0)
+	}
+	text, _ := content.GetString("modules.module_dynamic.desc.text")
+	title := ""
+	pics := make([]string, 0)
+
+	majorType, _ := content.GetString("modules.module_dynamic.major.type")
+	switch majorType {
+	case "MAJOR_TYPE_ARCHIVE":
+		avid := jsonId(content, "modules.module_dynamic.major.archive.aid")
+		bvid, _ := content.GetString("modules.module_dynamic.major.archive.bvid")
+		avidInt, err := strconv.Atoi(avid)
+		if err != nil || bvid == "" {
+			return info, published, false
+		}
+		info.Name, _ = content.GetString("modules.module_dynamic.major.archive.title")
+		meta.Cover, _ = content.GetString("modules.module_dynamic.major.archive.cover")
+		meta.Description, _ = content.GetString("modules.module_dynamic.major.archive.desc")
+		info.Id = videoCanonicalId(avidInt, "p1")
+		info.Site = "Bilibili"
+		info.Url = "https://www.bilibili.com/video/" + bvid
+		info.Type = downloader.RT_Video
+		info.Others = map[string]string{"avid": avid}
+		info.Metadata = meta
+		return info, published, true
+	case "MAJOR_TYPE_OPUS":
+		title, _ = content.GetString("modules.module_dynamic.major.opus.title")
+		if summary, err := content.GetString("modules.module_dynamic.major.opus.summary.text"); err == nil {
+			text = summary
+		}
+		elems, _ := content.GetArray("modules.module_dynamic.major.opus.pics")
+		for _, elem := range elems {
+			if u, err := utils.NewJsonNode(elem).GetString("url"); err == nil {
+				pics = append(pics, u)
+			}
+		}
+	case "MAJOR_TYPE_DRAW":
+		elems, _ := content.GetArray("modules.module_dynamic.major.draw.items")
+		for _, elem := range elems {
+			if u, err := utils.NewJsonNode(elem).GetString("src"); err == nil {
+				pics = append(pics, u)
+			}
+		}
+	case "", "MAJOR_TYPE_NONE":
+		// text only, or deleted if there is no text
+	default:
+		return info, published, false
+	}
+	if text == "" && len(pics) == 0 {
+		return info, published, false
+	}
+
+	info.Name = title
+	if info.Name == "" {
+		info.Name = dynamicTitle(text, id)
+	}
+	meta.Description = text
+	info.Id = downloader.CanonicalId("bilibili", "dynamic", id, "")
+	info.Site = "Bilibili"
+	info.Url = "https://t.bilibili.com/" + id
+	info.Type = downloader.RT_Text
+	info.Others = map[string]string{"dynamic_id": id}
+	info.Metadata = meta
+	if len(pics) > 0 {
+		info.Type = downloader.RT_Image
+		info.Streams = []downloader.StreamInfo{{Id: "images", Url: pics}}
+	}
+	return info, published, true
+}
+
+// dynamicTitle names a post without title after the start of its text.
+func dynamicTitle(text string, id string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if line == "" {
+		return "Dynamic " + id
+	}
+	if utf8.RuneCountInString(line) > 40 {
+		line = string([]rune(line)[:40]) + "…"
+	}
+	return line
+}
+
+// resolveCid fills the "cid" entry of info.Others with the first page of the
+// video "avid", for resources listed without it.
+func (b *Bilibili) resolveCid(info *downloader.ResourceInfo) error {
+	content, err := b.getContent(pageListApiUrl(info.Others["avid"]), b.getHeader(b.Url, ""))
+	if err != nil {
+		return fmt.Errorf("failed to get pages of av%s: %v", info.Others["avid"], err)
+	}
+	pages, err := utils.UnmarshalJson(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse pages of av%s: %v", info.Others["avid"], err)
+	}
+	cid, err := pages.GetInt("data.[0].cid")
+	if err != nil {
+		return fmt.Errorf("failed to get cid of av%s: %v", info.Others["avid"], err)
+	}
+	info.Others["cid"] = strconv.Itoa(cid)
+	return nil
+}
+
+// downloadPost saves the text of a post into "<name>.txt" and its images
+// into "<name>_01.jpg" and so on.
+func (b *Bilibili) downloadPost(info *downloader.ResourceInfo, dir string, progress chan *downloader.Progress) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	base := filepath.Join(dir, fileBaseName(info))
+	if info.Metadata.Description != "" {
+		text := info.Metadata.Description
+		if !info.Metadata.PublishTime.IsZero() {
+			text = fmt.Sprintf("%s\n%s\n\n%s\n", info.Metadata.Uploader, info.Metadata.PublishTime.Format("2006-01-02 15:04:05"), text)
+		}
+		if err := os.WriteFile(base+".txt", []byte(text), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	var images []string
+	if len(info.Streams) > 0 {
+		images = info.Streams[0].Url
+	}
+	for i, u := range images {
+		ext := path.Ext(strings.SplitN(u, "?", 2)[0])
+		if ext == "" {
+			ext = ".jpg"
+		}
+		file := fmt.Sprintf("%s_%02d%s", base, i+1, ext)
+		progress <- &downloader.Progress{
+			Status:     fmt.Sprintf("Downloading %s (%d/%d)", filepath.Base(file), i+1, len(images)),
+			Percentage: float32(i) / float32(len(images)),
+		}
+		req := newRequest(u, b.getHeader(info.Url, ""))
+		if err := utils.DownloadFile(b.httpClient.StreamClient(), req, file, nil); err != nil {
+			return "", fmt.Errorf("failed to download %s: %v", u, err)
+		}
+	}
+	return "Done.", nil
+}
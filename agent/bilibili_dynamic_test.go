@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"downloader"
+	"testing"
+	"time"
+
+	"internal/utils"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"36h":                       now.Add(-36 * time.Hour),
+		"7d":                        now.AddDate(0, 0, -7),
+		"2024-05-01T08:00:00+08:00": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		"1714521600":                time.Unix(1714521600, 0),
+	}
+	for input, expected := range cases {
+		got, err := parseSince(input, now)
+		if err != nil {
+			t.Errorf("parseSince(%s) returned error: %v", input, err)
+		} else if !got.Equal(expected) {
+			t.Errorf("parseSince(%s): expect %v, got %v", input, expected, got)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Errorf("expect error for invalid time")
+	}
+}
+
+func TestParseDynamicItem(t *testing.T) {
+	forward, _ := utils.UnmarshalJson([]byte(`{
+		"id_str": "100", "type": "DYNAMIC_TYPE_FORWARD",
+		"modules": {"module_author": {"mid": 1, "name": "a", "pub_ts": 1714521600}},
+		"orig": {
+			"id_str": "99", "type": "DYNAMIC_TYPE_AV",
+			"modules": {
+				"module_author": {"mid": 2, "name": "b", "pub_ts": 1714000000},
+				"module_dynamic": {"major": {"type": "MAJOR_TYPE_ARCHIVE",
+					"archive": {"aid": "170001", "bvid": "BV17x411w7KC", "title": "video"}}}
+			}
+		}
+	}`))
+	info, published, ok := parseDynamicItem(forward)
+	if !ok {
+		t.Fatalf("expect the forwarded video")
+	}
+	if info.Type != downloader.RT_Video || info.Id != "bilibili:video:BV17x411w7KC:p1" || info.Others["avid"] != "170001" {
+		t.Errorf("unexpected video %+v", info)
+	}
+	if info.Metadata.Uploader != "b" || published.Unix() != 1714521600 {
+		t.Errorf("expect the uploader of the video and the time of the forward, got %s and %v", info.Metadata.Uploader, published)
+	}
+
+	draw, _ := utils.UnmarshalJson([]byte(`{
+		"id_str": "101", "type": "DYNAMIC_TYPE_DRAW",
+		"modules": {
+			"module_author": {"mid": 1, "name": "a", "pub_ts": 1714521600},
+			"module_dynamic": {"desc": {"text": "photos\nof today"},
+				"major": {"type": "MAJOR_TYPE_DRAW", "draw": {"items": [{"src": "https://i0.hdslb.com/1.jpg"}, {"src": "https://i0.hdslb.com/2.png"}]}}}
+		}
+	}`))
+	info, _, ok = parseDynamicItem(draw)
+	if !ok || info.Type != downloader.RT_Image || info.Name != "photos" || len(info.Streams) != 1 || len(info.Streams[0].Url) != 2 {
+		t.Errorf("unexpected image post %+v", info)
+	}
+
+	live, _ := utils.UnmarshalJson([]byte(`{"id_str": "102", "type": "DYNAMIC_TYPE_LIVE_RCMD",
+		"modules": {"module_dynamic": {"major": {"type": "MAJOR_TYPE_LIVE_RCMD"}}}}`))
+	if _, _, ok := parseDynamicItem(live); ok {
+		t.Errorf("expect live recommendations to be skipped")
+	}
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"internal/utils"
+
+	"downloader"
+)
+
+// maxInteractiveEdges bounds the walk of a choice graph, in case the graph
+// reported by the API never ends.
+const maxInteractiveEdges = 1000
+
+// playerInfoApiUrl needs WBI signing, which is done by getContent.
+func playerInfoApiUrl(bvid string, cid string) string {
+	return fmt.Sprintf("https://api.bilibili.com/x/player/wbi/v2?bvid=%s&cid=%s", bvid, cid)
+}
+
+// edgeInfoApiUrl returns the url of a node in the choice graph. edgeId 0
+// refers to the root node.
+func edgeInfoApiUrl(bvid string, graphVersion int, edgeId int) string {
+	if edgeId == 0 {
+		return fmt.Sprintf("https://api.bilibili.com/x/stein/edgeinfo_v2?bvid=%s&graph_version=%d", bvid, graphVersion)
+	}
+	return fmt.Sprintf("https://api.bilibili.com/x/stein/edgeinfo_v2?bvid=%s&graph_version=%d&edge_id=%d", bvid, graphVersion, edgeId)
+}
+
+// interactiveGraph describes the choices of an interactive video. It is saved
+// next to the downloaded segments.
+type interactiveGraph struct {
+	Bvid         string            `json:"bvid"`
+	Title        string            `json:"title"`
+	GraphVersion int               `json:"graph_version"`
+	RootEdgeId   int               `json:"root_edge_id"`
+	Nodes        []interactiveNode `json:"nodes"`
+}
+
+// interactiveNode is a segment of an interactive video, reached through the
+// edge EdgeId.
+type interactiveNode struct {
+	EdgeId  int                 `json:"edge_id"`
+	Cid     int                 `json:"cid"`
+	Title   string              `json:"title"`
+	Choices []interactiveChoice `json:"choices,omitempty"`
+}
+
+type interactiveChoice struct {
+	EdgeId    int    `json:"edge_id"`
+	Cid       int    `json:"cid"`
+	Option    string `json:"option"`
+	Condition string `json:"condition,omitempty"`
+	Action    string `json:"action,omitempty"`
+	IsDefault bool   `json:"is_default,omitempty"`
+}
+
+// getVideoInfoInteractive walks the choice graph of an interactive video
+// and returns every reachable segment as a resource. Streams of the segments
+// are resolved when they are downloaded.
+func (b *Bilibili) getVideoInfoInteractive(initialState *utils.JsonNode) ([]downloader.ResourceInfo, error) {
+	bvid, err := initialState.GetString("videoData.bvid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bvid of interactive video: %v", err)
+	}
+	avid, err := initialState.GetInt("videoData.aid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get avid of interactive video: %v", err)
+	}
+	rootCid, err := initialState.GetInt("videoData.cid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cid of interactive video: %v", err)
+	}
+	title, _ := initialState.GetString("videoData.title")
+	meta := getVideoMetadata(initialState, 1)
+
+	playerContent, err := b.getContent(playerInfoApiUrl(bvid, strconv.Itoa(rootCid)), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get player info: %v", err)
+	}
+	playerJson, err := utils.UnmarshalJson(playerContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse player info as json: %v", err)
+	}
+	graphVersion, err := playerJson.GetInt("data.interaction.graph_version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get graph version of interactive video: %v", err)
+	}
+
+	graph := &interactiveGraph{Bvid: bvid, Title: title, GraphVersion: graphVersion}
+	resources := make([]downloader.ResourceInfo, 0)
+	visited := make(map[int]bool)
+	edgeCids := make(map[int]int)
+	queue := []int{0}
+	for len(queue) > 0 && len(visited) < maxInteractiveEdges {
+		edgeId := queue[0]
+		queue = queue[1:]
+		if visited[edgeId] {
+			continue
+		}
+		visited[edgeId] = true
+
+		node, err := b.getInteractiveNode(bvid, graphVersion, edgeId)
+		if err != nil {
+			return nil, err
+		}
+		if edgeId == 0 {
+			graph.RootEdgeId = node.EdgeId
+			visited[node.EdgeId] = true
+			edgeCids[node.EdgeId] = rootCid
+		}
+		if node.Cid == 0 {
+			node.Cid = edgeCids[node.EdgeId]
+		}
+		graph.Nodes = append(graph.Nodes, *node)
+		for _, choice := range node.Choices {
+			if !visited[choice.EdgeId] {
+				edgeCids[choice.EdgeId] = choice.Cid
+				queue = append(queue, choice.EdgeId)
+			}
+		}
+
+		resources = append(resources, downloader.ResourceInfo{
+			Id:       videoCanonicalId(avid, fmt.Sprintf("cid%d", node.Cid)),
+			Site:     "Bilibili",
+			Name:     fmt.Sprintf("%s (%s)", title, node.Title),
+			Url:      b.Url,
+			Type:     downloader.RT_Video,
+			Metadata: meta,
+			Others: map[string]string{
+				"avid":    strconv.Itoa(avid),
+				"cid":     strconv.Itoa(node.Cid),
+				"edge_id": strconv.Itoa(node.EdgeId),
+			},
+		})
+	}
+
+	b.interactiveGraph = graph
+	b.infoAcquired = true
+	// different edges can lead to the same segment
+	b.resourceInfos = downloader.Dedup(resources)
+	return b.resourceInfos, nil
+}
+
+// getInteractiveNode fetches a node of the choice graph and the choices leading
+// out of it.
+func (b *Bilibili) getInteractiveNode(bvid string, graphVersion int, edgeId int) (*interactiveNode, error) {
+	content, err := b.getContent(edgeInfoApiUrl(bvid, graphVersion, edgeId), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edge info: %v", err)
+	}
+	edgeJson, err := utils.UnmarshalJson(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse edge info as json: %v", err)
+	}
+	if code, err := edgeJson.GetInt("code"); err != nil || code != 0 {
+		message, _ := edgeJson.GetString("message")
+		return nil, fmt.Errorf("edge info api returned code %d: %s", code, message)
+	}
+
+	node := &interactiveNode{EdgeId: edgeId}
+	node.Title, _ = edgeJson.GetString("data.title")
+	if edgeId == 0 {
+		node.EdgeId, _ = edgeJson.GetInt("data.edge_id")
+	}
+	// the current node is marked in the story list
+	storyList, _ := edgeJson.GetArray("data.story_list")
+	for _, elem := range storyList {
+		story := utils.NewJsonNode(elem)
+		if current, _ := story.GetInt("is_current"); current == 1 {
+			node.Cid, _ = story.GetInt("cid")
+		}
+	}
+
+	questions, _ := edgeJson.GetArray("data.edges.questions")
+	for _, q := range questions {
+		choices, _ := utils.NewJsonNode(q).GetArray("choices")
+		for _, c := range choices {
+			choiceJson := utils.NewJsonNode(c)
+			var choice interactiveChoice
+			choice.EdgeId, err = choiceJson.GetInt("id")
+			if err != nil {
+				// log
+				continue
+			}
+			choice.Cid, _ = choiceJson.GetInt("cid")
+			choice.Option, _ = choiceJson.GetString("option")
+			choice.Condition, _ = choiceJson.GetString("condition")
+			choice.Action, _ = choiceJson.GetString("native_action")
+			isDefault, _ := choiceJson.GetInt("is_default")
+			choice.IsDefault = isDefault == 1
+			node.Choices = append(node.Choices, choice)
+		}
+	}
+	return node, nil
+}
+
+// saveInteractiveGraph writes the choice graph as "<title>.graph.json" into dir.
+func (b *Bilibili) saveInteractiveGraph(dir string) error {
+	if b.interactiveGraph == nil {
+		return nil
+	}
+	if dir == "" {
+		dir = "."
+	}
+	content, err := json.MarshalIndent(b.interactiveGraph, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, utils.SanitizeFilename(b.interactiveGraph.Title)+".graph.json")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to save choice graph: %v", err)
+	}
+	return nil
+}
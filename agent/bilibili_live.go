@@ -0,0 +1,618 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"internal/utils"
+
+	"downloader"
+)
+
+// Live rooms and the danmaku broadcast, see
+// https://github.com/SocialSisterYi/bilibili-API-collect/blob/master/docs/live/message_stream.md
+
+func liveDanmuInfoApiUrl(roomid string) string {
+	// signed like the WBI APIs although the path does not say so
+	return fmt.Sprintf("https://api.live.bilibili.com/xlive/web-room/v1/index/getDanmuInfo?id=%s&type=0", roomid)
+}
+
+const liveHeartbeatInterval = 30 * time.Second
+
+// a recording receiving nothing for liveStallTimeout, response headers
+// included, is aborted as stalled
+var liveStallTimeout = 30 * time.Second
+
+// operations of the broadcast packets
+const (
+	liveOpHeartbeat      = 2
+	liveOpHeartbeatReply = 3
+	liveOpMessage        = 5
+	liveOpAuth           = 7
+	liveOpAuthReply      = 8
+)
+
+// protocol versions of the broadcast packets. Brotli (version 3) is what the
+// web player asks for, but there is no brotli decoder at hand, so we ask for
+// zlib, which the server still honours.
+const (
+	liveProtoJson   = 0
+	liveProtoInt    = 1
+	liveProtoZlib   = 2
+	liveProtoBrotli = 3
+)
+
+const livePacketHeaderSize = 16
+
+// times of the live apis are in China Standard Time
+var chinaTimezone = time.FixedZone("CST", 8*60*60)
+
+var liveRoomRegex = regexp.MustCompile(`https?://live\.bilibili\.com/(?:blanc/)?(\d+)`)
+
+type livePacket struct {
+	protover uint16
+	op       uint32
+	body     []byte
+}
+
+// encodeLivePacket adds the header to body: packet length, header length,
+// protocol version, operation and sequence, all big endian.
+func encodeLivePacket(op uint32, body []byte) []byte {
+	packet := make([]byte, livePacketHeaderSize, livePacketHeaderSize+len(body))
+	binary.BigEndian.PutUint32(packet[0:], uint32(livePacketHeaderSize+len(body)))
+	binary.BigEndian.PutUint16(packet[4:], livePacketHeaderSize)
+	binary.BigEndian.PutUint16(packet[6:], liveProtoInt)
+	binary.BigEndian.PutUint32(packet[8:], op)
+	binary.BigEndian.PutUint32(packet[12:], 1)
+	return append(packet, body...)
+}
+
+// decodeLivePackets splits a websocket message into packets. Compressed
+// packets wrap further packets, which are decoded recursively.
+func decodeLivePackets(data []byte) ([]livePacket, error) {
+	packets := make([]livePacket, 0)
+	for len(data) > 0 {
+		if len(data) < livePacketHeaderSize {
+			return nil, fmt.Errorf("live packet is too short: %d bytes", len(data))
+		}
+		length := int(binary.BigEndian.Uint32(data[0:]))
+		headerLength := int(binary.BigEndian.Uint16(data[4:]))
+		if length > len(data) || headerLength < livePacketHeaderSize || headerLength > length {
+			return nil, fmt.Errorf("ill-formated live packet header")
+		}
+		p := livePacket{
+			protover: binary.BigEndian.Uint16(data[6:]),
+			op:       binary.BigEndian.Uint32(data[8:]),
+			body:     data[headerLength:length],
+		}
+		data = data[length:]
+
+		switch p.protover {
+		case liveProtoZlib:
+			r, err := zlib.NewReader(bytes.NewReader(p.body))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress live packet: %v", err)
+			}
+			inflated, err := io.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress live packet: %v", err)
+			}
+			inner, err := decodeLivePackets(inflated)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, inner...)
+		case liveProtoBrotli:
+			// not asked for, see liveProtoBrotli, losing a few messages is
+			// better than losing the connection
+			warnf("skipping a brotli compressed live packet of %d bytes", len(p.body))
+		default:
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
+
+// liveEvent is an entry of the live chat. Offset is relative to the start
+// of the recording, so the chat can be played along with it.
+type liveEvent struct {
+	Kind     string    `json:"kind"` // danmaku, gift or superchat
+	Offset   float64   `json:"offset"`
+	Time     time.Time `json:"time"`
+	Uid      int       `json:"uid"`
+	User     string    `json:"user"`
+	Text     string    `json:"text,omitempty"`
+	Mode     int       `json:"mode,omitempty"`
+	FontSize int       `json:"font_size,omitempty"`
+	Color    int       `json:"color,omitempty"`
+	Gift     string    `json:"gift,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	// gifts are priced in gold coins, 1000 per yuan; super chats in yuan
+	Price int `json:"price,omitempty"`
+	// how long a super chat is pinned, in seconds
+	Duration int `json:"duration,omitempty"`
+}
+
+// parseLiveMessage turns a broadcast message into an event. ok is false for
+// the commands not recorded, e.g. room status and ranking updates.
+func parseLiveMessage(body []byte) (event liveEvent, ok bool) {
+	j, err := utils.UnmarshalJson(body)
+	if err != nil {
+		return event, false
+	}
+	cmd, err := j.GetString("cmd")
+	if err != nil {
+		return event, false
+	}
+	// some commands carry flags, e.g. "DANMU_MSG:4:0:2:2:2:0"
+	cmd, _, _ = strings.Cut(cmd, ":")
+
+	switch cmd {
+	case "DANMU_MSG":
+		event.Kind = "danmaku"
+		event.Text, err = j.GetString("info.[1]")
+		if err != nil {
+			return event, false
+		}
+		event.Mode, _ = j.GetInt("info.[0].[1]")
+		event.FontSize, _ = j.GetInt("info.[0].[2]")
+		event.Color, _ = j.GetInt("info.[0].[3]")
+		event.Uid, _ = j.GetInt("info.[2].[0]")
+		event.User, _ = j.GetString("info.[2].[1]")
+	case "SEND_GIFT":
+		event.Kind = "gift"
+		event.Gift, err = j.GetString("data.giftName")
+		if err != nil {
+			return event, false
+		}
+		event.Uid, _ = j.GetInt("data.uid")
+		event.User, _ = j.GetString("data.uname")
+		event.Count, _ = j.GetInt("data.num")
+		if coinType, _ := j.GetString("data.coin_type"); coinType == "gold" {
+			price, _ := j.GetInt("data.price")
+			event.Price = price * event.Count
+		}
+	case "SUPER_CHAT_MESSAGE":
+		event.Kind = "superchat"
+		event.Text, err = j.GetString("data.message")
+		if err != nil {
+			return event, false
+		}
+		event.Uid, _ = j.GetInt("data.uid")
+		event.User, _ = j.GetString("data.user_info.uname")
+		event.Price, _ = j.GetInt("data.price")
+		event.Duration, _ = j.GetInt("data.time")
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// liveChatWriter writes the chat to a JSONL file, one event per line, and to
+// an XML file in the danmaku format of Bilibili, with gifts and super chats
+// as <gift> and <sc> elements like other live recorders do.
+type liveChatWriter struct {
+	mu        sync.Mutex
+	jsonFile  *os.File
+	xmlFile   *os.File
+	xmlWriter *bufio.Writer
+	count     int
+}
+
+func newLiveChatWriter(base string) (*liveChatWriter, error) {
+	jsonFile, err := os.Create(base + ".danmaku.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	xmlFile, err := os.Create(base + ".danmaku.xml")
+	if err != nil {
+		jsonFile.Close()
+		return nil, err
+	}
+	w := &liveChatWriter{jsonFile: jsonFile, xmlFile: xmlFile, xmlWriter: bufio.NewWriter(xmlFile)}
+	w.xmlWriter.WriteString(xml.Header + "<i>\n")
+	return w, nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func (w *liveChatWriter) Write(event *liveEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.jsonFile.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	offset := strconv.FormatFloat(event.Offset, 'f', 3, 64)
+	switch event.Kind {
+	case "danmaku":
+		fmt.Fprintf(w.xmlWriter, `<d p="%s,%d,%d,%d,%d,0,%d,0" user="%s">%s</d>`+"\n",
+			offset, event.Mode, event.FontSize, event.Color, event.Time.Unix(), event.Uid,
+			xmlEscape(event.User), xmlEscape(event.Text))
+	case "gift":
+		fmt.Fprintf(w.xmlWriter, `<gift ts="%s" user="%s" uid="%d" giftname="%s" giftcount="%d" price="%d"/>`+"\n",
+			offset, xmlEscape(event.User), event.Uid, xmlEscape(event.Gift), event.Count, event.Price)
+	case "superchat":
+		fmt.Fprintf(w.xmlWriter, `<sc ts="%s" user="%s" uid="%d" price="%d" time="%d">%s</sc>`+"\n",
+			offset, xmlEscape(event.User), event.Uid, event.Price, event.Duration, xmlEscape(event.Text))
+	}
+	w.count++
+	return nil
+}
+
+func (w *liveChatWriter) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Close completes the XML file and closes both files.
+func (w *liveChatWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.xmlWriter.WriteString("</i>\n")
+	err := w.xmlWriter.Flush()
+	if err2 := w.xmlFile.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.jsonFile.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (b *Bilibili) getVideoInfoLive(htmlContent []byte) ([]downloader.ResourceInfo, error) {
+	match := liveRoomRegex.FindStringSubmatch(b.Url)
+	if match == nil {
+		return nil, fmt.Errorf("no room id in live url %s", b.Url)
+	}
+
+	// the room in the url may be a short id, room_init resolves it.
+	// Neither api goes through the cache, the room status keeps changing.
+	initJson, err := b.getJsonUncached(liveRoomInitApiUrl(match[1]), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live room: %v", err)
+	}
+	if code, _ := initJson.GetInt("code"); code != 0 {
+		message, _ := initJson.GetString("message")
+		return nil, fmt.Errorf("failed to get live room %s: %s", match[1], message)
+	}
+	roomId, err := initJson.GetInt("data.room_id")
+	if err != nil {
+		return nil, fmt.Errorf("ill-formated live room response: %v", err)
+	}
+	roomIdStr := strconv.Itoa(roomId)
+	if status, _ := initJson.GetInt("data.live_status"); status != 1 {
+		return nil, fmt.Errorf("live room %s is not streaming", roomIdStr)
+	}
+
+	roomJson, err := b.getJsonUncached(liveRoomInfoApiUrl(roomIdStr), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live room information: %v", err)
+	}
+	title, err := roomJson.GetString("data.title")
+	if err != nil {
+		return nil, fmt.Errorf("ill-formated live room information: %v", err)
+	}
+	var meta downloader.Metadata
+	if uid, err := roomJson.GetInt("data.uid"); err == nil {
+		meta.UploaderId = strconv.Itoa(uid)
+	}
+	meta.Description, _ = roomJson.GetString("data.description")
+	meta.Cover, _ = roomJson.GetString("data.user_cover")
+	meta.Views, _ = roomJson.GetInt("data.online")
+	if tags, _ := roomJson.GetString("data.tags"); tags != "" {
+		meta.Tags = strings.Split(tags, ",")
+	}
+	// the live session is what gets recorded, so it is part of the id
+	session := ""
+	if liveTime, _ := roomJson.GetString("data.live_time"); liveTime != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", liveTime, chinaTimezone); err == nil {
+			meta.PublishTime = t
+			session = strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+
+	playJson, err := b.getJsonUncached(liveApiUrl(roomIdStr), b.getHeader(b.Url, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live stream: %v", err)
+	}
+	// the durl entries of a live stream are mirrors of each other
+	durls, _ := playJson.GetArray("data.durl")
+	mirrors := make([]string, 0, len(durls))
+	for _, elem := range durls {
+		if u, err := utils.NewJsonNode(elem).GetString("url"); err == nil {
+			mirrors = append(mirrors, u)
+		}
+	}
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("failed to get live stream of room %s", roomIdStr)
+	}
+
+	info := downloader.ResourceInfo{
+		Id:       downloader.CanonicalId("bilibili", "live", roomIdStr, session),
+		Site:     "Bilibili",
+		Name:     title,
+		Url:      "https://live.bilibili.com/" + roomIdStr,
+		Type:     downloader.RT_Video,
+		Others:   map[string]string{"room_id": roomIdStr},
+		Metadata: meta,
+		Streams: []downloader.StreamInfo{{
+			Id:           "live-flv",
+			Container:    "flv",
+			DownloadWith: "--format=live-flv",
+			Url:          mirrors[:1],
+			BackupUrl:    [][]string{mirrors[1:]},
+		}},
+	}
+	b.resourceInfos = []downloader.ResourceInfo{info}
+	b.infoAcquired = true
+	return b.resourceInfos, nil
+}
+
+// recordLive records the live stream of info into dir until the stream ends
+// or the "record-duration" parameter, a duration like "1h30m", elapses.
+// Unless the "no-danmaku" parameter is given, the chat is recorded alongside.
+func (b *Bilibili) recordLive(info *downloader.ResourceInfo, dir string, progress chan *downloader.Progress) (status string, err error) {
+	var duration time.Duration
+	if d, ok := b.downloadParams["record-duration"]; ok {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			return "", fmt.Errorf("invalid record duration %q", d)
+		}
+	}
+	if len(info.Streams) == 0 || len(info.Streams[0].Url) == 0 {
+		return "", fmt.Errorf("no live stream available")
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the client has no timeout, the recording lasts as long as the stream
+	stalled := atomic.Bool{}
+	stall := time.AfterFunc(liveStallTimeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer stall.Stop()
+	// connect to the first mirror that serves the stream
+	var resp *http.Response
+	for _, u := range info.Streams[0].Mirrors(0) {
+		req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
+		for k, v := range b.getHeader(info.Url, "") {
+			req.Header.Set(k, v)
+		}
+		stall.Reset(liveStallTimeout)
+		resp, err = b.httpClient.StreamClient().Do(req)
+		if err != nil {
+			err = fmt.Errorf("GET request got error: %v", err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("http status code is %d", resp.StatusCode)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		if stalled.Load() {
+			return "", fmt.Errorf("%w: no response from the live stream in %s", utils.ErrDownloadStalled, liveStallTimeout)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// the chat is aligned to the moment the stream starts arriving
+	start := time.Now()
+	base := filepath.Join(dir, fileBaseName(info)+" "+start.Format("20060102-150405"))
+	file, err := os.Create(base + ".flv")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if duration > 0 {
+		time.AfterFunc(duration, cancel)
+	}
+
+	var chat *liveChatWriter
+	if _, ok := b.downloadParams["no-danmaku"]; !ok {
+		chat, err = newLiveChatWriter(base)
+		if err != nil {
+			return "", err
+		}
+		var chatErr error
+		var chatDone sync.WaitGroup
+		chatDone.Add(1)
+		go func() {
+			defer chatDone.Done()
+			chatErr = b.recordLiveChat(ctx, info.Others["room_id"], start, chat)
+		}()
+		// the chat stops with the recording, whichever way it ends
+		defer func() {
+			cancel()
+			chatDone.Wait()
+			if err := chat.Close(); err != nil && chatErr == nil {
+				chatErr = err
+			}
+			if chatErr != nil && status != "" {
+				status += fmt.Sprintf(" The chat was not fully recorded: %v", chatErr)
+			}
+		}()
+	}
+
+	written := int64(0)
+	lastReport := time.Time{}
+	buf := make([]byte, 256*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			stall.Reset(liveStallTimeout)
+			if _, err := file.Write(buf[:n]); err != nil {
+				return "", fmt.Errorf("failed to write file %s: %v", file.Name(), err)
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			// EOF when the streamer stops, canceled when the duration is over
+			if err != io.EOF && ctx.Err() == nil {
+				return "", fmt.Errorf("failed to read live stream: %v", err)
+			}
+			break
+		}
+		if time.Since(lastReport) >= time.Second {
+			lastReport = time.Now()
+			elapsed := time.Since(start)
+			var percentage float32
+			if duration > 0 {
+				percentage = min(float32(elapsed)/float32(duration), 0.99)
+			}
+			status := fmt.Sprintf("Recording %s, %.1f MB", elapsed.Truncate(time.Second), float64(written)/(1<<20))
+			if chat != nil {
+				status += fmt.Sprintf(", %d chat messages", chat.Count())
+			}
+			progress <- &downloader.Progress{Status: status, Percentage: percentage}
+		}
+	}
+
+	cancel()
+	status = fmt.Sprintf("Done. Recorded %s.", time.Since(start).Truncate(time.Second))
+	if stalled.Load() {
+		status += fmt.Sprintf(" The stream stopped with nothing received in %s.", liveStallTimeout)
+	}
+	return status, nil
+}
+
+// recordLiveChat connects to the danmaku broadcast of room and writes its
+// events to w until ctx is done.
+func (b *Bilibili) recordLiveChat(ctx context.Context, room string, start time.Time, w *liveChatWriter) error {
+	infoJson, err := b.getJsonUncached(liveDanmuInfoApiUrl(room), b.getHeader("https://live.bilibili.com/"+room, ""))
+	if err != nil {
+		return fmt.Errorf("failed to get danmaku server: %v", err)
+	}
+	token, err := infoJson.GetString("data.token")
+	if err != nil {
+		return fmt.Errorf("failed to get danmaku token: %v", err)
+	}
+	host, err := infoJson.GetString("data.host_list.[0].host")
+	if err != nil {
+		return fmt.Errorf("failed to get danmaku server: %v", err)
+	}
+	port, err := infoJson.GetInt("data.host_list.[0].wss_port")
+	if err != nil {
+		return fmt.Errorf("failed to get danmaku server: %v", err)
+	}
+
+	header := make(http.Header)
+	for k, v := range b.getHeader("https://live.bilibili.com/"+room, "") {
+		header.Set(k, v)
+	}
+	header.Set("Origin", "https://live.bilibili.com")
+	wsUrl := fmt.Sprintf("wss://%s:%d/sub", host, port)
+	proxy, err := b.httpClient.Proxy(wsUrl)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy of danmaku server: %v", err)
+	}
+	conn, err := utils.DialWebsocket(wsUrl, header, proxy)
+	if err != nil {
+		return fmt.Errorf("failed to connect to danmaku server: %v", err)
+	}
+	defer conn.Close()
+
+	// anonymous clients get the chat with masked user names
+	uid, _ := strconv.Atoi(b.jar.Value("https://api.live.bilibili.com/", "DedeUserID"))
+	roomId, _ := strconv.Atoi(room)
+	auth, _ := json.Marshal(map[string]interface{}{
+		"uid":      uid,
+		"roomid":   roomId,
+		"protover": liveProtoZlib,
+		"buvid":    b.jar.Value("https://api.live.bilibili.com/", "buvid3"),
+		"platform": "web",
+		"type":     2,
+		"key":      token,
+	})
+	if err := conn.WriteMessage(utils.WebsocketBinary, encodeLivePacket(liveOpAuth, auth)); err != nil {
+		return fmt.Errorf("failed to authenticate to danmaku server: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(liveHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// unblocks the read below
+				conn.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				conn.WriteMessage(utils.WebsocketBinary, encodeLivePacket(liveOpHeartbeat, nil))
+			}
+		}
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("danmaku connection broke: %v", err)
+		}
+		now := time.Now()
+		packets, err := decodeLivePackets(message)
+		if err != nil {
+			return err
+		}
+		for _, p := range packets {
+			switch p.op {
+			case liveOpAuthReply:
+				if code, err := utils.UnmarshalJson(p.body); err == nil {
+					if c, _ := code.GetInt("code"); c != 0 {
+						return fmt.Errorf("danmaku server rejected authentication with code %d", c)
+					}
+				}
+			case liveOpMessage:
+				event, ok := parseLiveMessage(p.body)
+				if !ok {
+					continue
+				}
+				event.Time = now
+				event.Offset = max(now.Sub(start).Seconds(), 0)
+				if err := w.Write(&event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
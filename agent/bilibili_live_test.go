@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeLivePackets(t *testing.T) {
+	danmaku := encodeLivePacket(liveOpMessage, []byte(`{"cmd":"DANMU_MSG:4:0:2:2:2:0","info":[[0,1,25,16777215,1700000000000],"hello",[42,"viewer"]]}`))
+	gift := encodeLivePacket(liveOpMessage, []byte(`{"cmd":"SEND_GIFT","data":{"giftName":"flower","uid":7,"uname":"fan","num":3,"price":100,"coin_type":"gold"}}`))
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(append(danmaku, gift...))
+	zw.Close()
+	wrapper := encodeLivePacket(liveOpMessage, compressed.Bytes())
+	binary.BigEndian.PutUint16(wrapper[6:], liveProtoZlib)
+	heartbeatReply := encodeLivePacket(liveOpHeartbeatReply, []byte{0, 0, 0, 1})
+
+	packets, err := decodeLivePackets(append(wrapper, heartbeatReply...))
+	if err != nil {
+		t.Fatalf("decodeLivePackets() returned error: %v", err)
+	}
+	if len(packets) != 3 {
+		t.Fatalf("expect 3 packets, got %d", len(packets))
+	}
+	if packets[2].op != liveOpHeartbeatReply {
+		t.Errorf("expect heartbeat reply last, got op %d", packets[2].op)
+	}
+
+	event, ok := parseLiveMessage(packets[0].body)
+	if !ok || event.Kind != "danmaku" || event.Text != "hello" || event.Uid != 42 || event.User != "viewer" || event.Color != 16777215 {
+		t.Errorf("unexpected danmaku event %+v", event)
+	}
+	event, ok = parseLiveMessage(packets[1].body)
+	if !ok || event.Kind != "gift" || event.Gift != "flower" || event.Count != 3 || event.Price != 300 {
+		t.Errorf("unexpected gift event %+v", event)
+	}
+	if _, ok := parseLiveMessage([]byte(`{"cmd":"ONLINE_RANK_COUNT","data":{}}`)); ok {
+		t.Errorf("expect unrecorded commands to be skipped")
+	}
+}
+
+func TestDecodeLivePacketsSkipsBrotli(t *testing.T) {
+	brotli := encodeLivePacket(liveOpMessage, []byte{0x1b, 0x03, 0x00, 0xf8})
+	binary.BigEndian.PutUint16(brotli[6:], liveProtoBrotli)
+	heartbeatReply := encodeLivePacket(liveOpHeartbeatReply, []byte{0, 0, 0, 1})
+
+	packets, err := decodeLivePackets(append(brotli, heartbeatReply...))
+	if err != nil {
+		t.Fatalf("decodeLivePackets() returned error: %v", err)
+	}
+	if len(packets) != 1 || packets[0].op != liveOpHeartbeatReply {
+		t.Errorf("expect the brotli packet to be skipped, got %+v", packets)
+	}
+}
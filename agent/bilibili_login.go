@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"downloader"
+	"internal/utils"
+)
+
+// QR code login, see
+// https://github.com/SocialSisterYi/bilibili-API-collect/blob/master/docs/login/login_action/QR.md
+
+// variables for tests
+var (
+	qrPollInterval = 2 * time.Second
+	qrTimeout      = 3 * time.Minute
+)
+
+// codes returned by the QR poll api
+const (
+	qrCodeSuccess    = 0
+	qrCodeExpired    = 86038
+	qrCodeScanned    = 86090
+	qrCodeNotScanned = 86101
+)
+
+func qrGenerateApiUrl() string {
+	return "https://passport.bilibili.com/x/passport-login/web/qrcode/generate"
+}
+
+func qrPollApiUrl(qrcodeKey string) string {
+	return fmt.Sprintf("https://passport.bilibili.com/x/passport-login/web/qrcode/poll?qrcode_key=%s", qrcodeKey)
+}
+
+// BilibiliCredential is what a login produces: the cookies of the logged-in
+// session and the token to refresh them.
+type BilibiliCredential struct {
+	Cookies      []*http.Cookie `json:"cookies"`
+	RefreshToken string         `json:"refresh_token"`
+}
+
+// DefaultBilibiliCredentialPath returns where credentials are stored unless
+// told otherwise.
+func DefaultBilibiliCredentialPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "downloader", "bilibili.json"), nil
+}
+
+// LoadBilibiliCredential reads credentials saved by Save.
+func LoadBilibiliCredential(path string) (*BilibiliCredential, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c BilibiliCredential
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse credential file %s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the credential to path, readable by the current user only.
+func (c *BilibiliCredential) Save(path string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// Cookie returns the value of the cookie with the given name, or "" if the
+// credential does not have it.
+func (c *BilibiliCredential) Cookie(name string) string {
+	for _, cookie := range c.Cookies {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// BilibiliQrLogin is QrLogin with an agent created with options.
+func BilibiliQrLogin(options downloader.AgentOptions, show func(url string), status func(message string)) (*BilibiliCredential, error) {
+	return NewBilibiliWithOptions("", "", options).QrLogin(show, status)
+}
+
+// QrLogin runs the QR code login with the http client of the agent, so its
+// proxies, retries and user agent apply. show is called with the url to
+// encode in the QR code, status with progress messages while polling.
+func (b *Bilibili) QrLogin(show func(url string), status func(message string)) (*BilibiliCredential, error) {
+	resp, err := b.httpClient.Client().Do(newRequest(qrGenerateApiUrl(), b.getHeader("", "")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate QR code: %v", err)
+	}
+	generateJson, err := decodeJsonResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate QR code: %v", err)
+	}
+	loginUrl, err := generateJson.GetString("data.url")
+	if err != nil {
+		return nil, fmt.Errorf("ill-formated QR code generation response: %v", err)
+	}
+	qrcodeKey, err := generateJson.GetString("data.qrcode_key")
+	if err != nil {
+		return nil, fmt.Errorf("ill-formated QR code generation response: %v", err)
+	}
+	show(loginUrl)
+
+	deadline := time.Now().Add(qrTimeout)
+	lastCode := -1
+	for time.Now().Before(deadline) {
+		time.Sleep(qrPollInterval)
+
+		// the response is different on every poll and carries the cookies,
+		// so it does not go through the cache.
+		resp, err := b.httpClient.Client().Do(newRequest(qrPollApiUrl(qrcodeKey), b.getHeader("", "")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to poll QR code status: %v", err)
+		}
+		pollJson, err := decodeJsonResponse(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to poll QR code status: %v", err)
+		}
+		code, err := pollJson.GetInt("data.code")
+		if err != nil {
+			return nil, fmt.Errorf("ill-formated QR code poll response: %v", err)
+		}
+		if code != lastCode {
+			lastCode = code
+			switch code {
+			case qrCodeNotScanned:
+				status("Waiting for the QR code to be scanned.")
+			case qrCodeScanned:
+				status("Scanned. Waiting for confirmation on the phone.")
+			}
+		}
+
+		switch code {
+		case qrCodeSuccess:
+			// let the jar resolve the domains of the cookies
+			jar := utils.NewCookieJar()
+			jar.SetCookies(resp.Request.URL, resp.Cookies())
+			credential := &BilibiliCredential{Cookies: jar.All()}
+			credential.RefreshToken, _ = pollJson.GetString("data.refresh_token")
+			if credential.Cookie("SESSDATA") == "" {
+				return nil, fmt.Errorf("login succeeded but no SESSDATA cookie was returned")
+			}
+			return credential, nil
+		case qrCodeExpired:
+			return nil, fmt.Errorf("the QR code has expired")
+		case qrCodeScanned, qrCodeNotScanned:
+		default:
+			message, _ := pollJson.GetString("data.message")
+			return nil, fmt.Errorf("QR code login failed with code %d: %s", code, message)
+		}
+	}
+	return nil, fmt.Errorf("timed out waiting for the QR code to be confirmed")
+}
+
+// decodeJsonResponse reads and closes the body of resp and parses it as json.
+func decodeJsonResponse(resp *http.Response) (*utils.JsonNode, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status code is %d", resp.StatusCode)
+	}
+	var v interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to parse response as json: %v", err)
+	}
+	return utils.NewJsonNode(v), nil
+}
@@ -0,0 +1,620 @@
+package agent
+
+import (
+	"bytes"
+	"downloader"
+	"encoding/json"
+	"fmt"
+	"internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the video served by mockBilibili
+const (
+	mockAid   = 170001
+	mockCid   = 279786
+	mockTitle = "Mock video"
+
+	mockCdnHost    = "upos-sz-mirrorcos.bilivideo.com"
+	mockBackupHost = "upos-sz-mirrorhw.bilivideo.com"
+)
+
+// mockBilibili is a fake of the Bilibili sites serving a single video: its
+// page with __INITIAL_STATE__ and __playinfo__, the nav and playurl APIs, and
+// its DASH and FLV media on a CDN host and a backup host, both answering
+// range requests. Its knobs make it fail like the real sites do.
+type mockBilibili struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// remaining requests to answer with 500 and 412, by path
+	failures  map[string]int
+	throttled map[string]int
+	// CDN hosts answering with 403, as they do once urls expire
+	expiredHosts map[string]bool
+	// CDN hosts dropping the connection after half of the media
+	truncatingHosts map[string]bool
+	// "<method> <host><path>" of every request
+	requests []string
+	// content served instead of mockMedia, by file name
+	media map[string][]byte
+	// polls of the QR code login answered so far
+	qrPolls int
+}
+
+func newMockBilibili(t *testing.T) *mockBilibili {
+	m := &mockBilibili{
+		failures:        make(map[string]int),
+		throttled:       make(map[string]int),
+		expiredHosts:    make(map[string]bool),
+		truncatingHosts: make(map[string]bool),
+		media:           make(map[string][]byte),
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// newAgent creates an agent for url whose requests, to any host, are sent
+// to the mock.
+func (m *mockBilibili) newAgent(url string) *Bilibili {
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		redirected := req.Clone(req.Context())
+		redirected.Host = req.URL.Host
+		redirected.URL.Scheme = "http"
+		redirected.URL.Host = m.server.Listener.Addr().String()
+		resp, err := http.DefaultTransport.RoundTrip(redirected)
+		if err == nil {
+			// cookies are set for the host of the original request
+			resp.Request = req
+		}
+		return resp, err
+	})
+	b := NewBilibiliWithOptions(url, "", downloader.AgentOptions{Transport: transport})
+	b.SetRateLimit("*", 0)
+	return b
+}
+
+func (m *mockBilibili) fail(path string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[path] = n
+}
+
+func (m *mockBilibili) throttle(path string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.throttled[path] = n
+}
+
+func (m *mockBilibili) expire(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiredHosts[host] = true
+}
+
+func (m *mockBilibili) truncate(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.truncatingHosts[host] = true
+}
+
+// setMedia serves content as the media file name.
+func (m *mockBilibili) setMedia(name string, content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.media[name] = content
+}
+
+// requested returns how many requests with method were sent to host and
+// path.
+func (m *mockBilibili) requested(method string, host string, path string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, r := range m.requests {
+		if r == method+" "+host+path {
+			n++
+		}
+	}
+	return n
+}
+
+// mockMedia returns the content of the media file name, distinct for every
+// name.
+func mockMedia(name string) []byte {
+	size := 64 << 10
+	if strings.HasSuffix(name, ".flv") {
+		size = 96 << 10
+	}
+	content := bytes.Repeat([]byte(name+";"), size/(len(name)+1)+1)
+	return content[:size]
+}
+
+func mockMediaUrls(name string) (string, []string) {
+	path := "/upgcxcode/01/02/" + strconv.Itoa(mockCid) + "/" + name
+	return "https://" + mockCdnHost + path, []string{"https://" + mockBackupHost + path}
+}
+
+func (m *mockBilibili) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests = append(m.requests, r.Method+" "+r.Host+r.URL.Path)
+	failing := m.failures[r.URL.Path] > 0
+	if failing {
+		m.failures[r.URL.Path]--
+	}
+	throttled := !failing && m.throttled[r.URL.Path] > 0
+	if throttled {
+		m.throttled[r.URL.Path]--
+	}
+	expired := m.expiredHosts[r.Host]
+	truncating := m.truncatingHosts[r.Host]
+	media, ok := m.media[filepath.Base(r.URL.Path)]
+	if !ok {
+		media = mockMedia(filepath.Base(r.URL.Path))
+	}
+	m.mu.Unlock()
+
+	switch {
+	case failing:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	case throttled:
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case r.Host == mockCdnHost || r.Host == mockBackupHost:
+		serveMockMedia(w, r, media, expired, truncating)
+	case r.Host == "www.bilibili.com" && strings.HasPrefix(r.URL.Path, "/video/"):
+		m.servePage(w, r)
+	case r.Host == "api.bilibili.com" && r.URL.Path == "/x/web-interface/nav":
+		writeMockJson(w, map[string]any{"code": -101, "message": "账号未登录", "data": map[string]any{
+			"isLogin": false,
+			"wbi_img": map[string]any{
+				"img_url": "https://i0.hdslb.com/bfs/wbi/7cd084941338484aae1ad9425b84077c.png",
+				"sub_url": "https://i0.hdslb.com/bfs/wbi/4932caff0ff746eab6f01bf08b70ac45.png",
+			},
+		}})
+	case r.Host == "api.bilibili.com" && r.URL.Path == "/x/player/wbi/playurl":
+		m.servePlayurl(w, r)
+	case r.Host == "api.bilibili.com" && r.URL.Path == "/pgc/player/web/v2/playurl":
+		writeMockJson(w, map[string]any{"code": -404, "message": "啥都木有"})
+	case r.Host == "passport.bilibili.com" && r.URL.Path == "/x/passport-login/web/qrcode/generate":
+		writeMockJson(w, map[string]any{"code": 0, "message": "0", "data": map[string]any{
+			"url":        "https://account.bilibili.com/h5/account-h5/auth/scan-web?qrcode_key=mockkey",
+			"qrcode_key": "mockkey",
+		}})
+	case r.Host == "passport.bilibili.com" && r.URL.Path == "/x/passport-login/web/qrcode/poll":
+		m.serveQrPoll(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeMockJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func serveMockMedia(w http.ResponseWriter, r *http.Request, content []byte, expired bool, truncating bool) {
+	if expired {
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	if truncating && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+func (m *mockBilibili) servePage(w http.ResponseWriter, r *http.Request) {
+	initialState := map[string]any{
+		"aid":  mockAid,
+		"bvid": AvToBv(mockAid),
+		"videoData": map[string]any{
+			"aid":      mockAid,
+			"bvid":     AvToBv(mockAid),
+			"title":    mockTitle,
+			"videos":   1,
+			"pubdate":  1700000000,
+			"duration": 120,
+			"desc":     "A video served by the mock.",
+			"owner":    map[string]any{"mid": 42, "name": "Mock uploader"},
+			"stat":     map[string]any{"view": 1000, "like": 100},
+			"pages":    []any{map[string]any{"cid": mockCid, "page": 1, "part": "P1", "duration": 120}},
+			"rights":   map[string]any{"is_stein_gate": 0},
+		},
+	}
+	dashVideo := func(quality int, codecId int, codecs string, width int, height int) map[string]any {
+		url, backups := mockMediaUrls(fmt.Sprintf("%d-%d.m4s", quality, codecId))
+		return map[string]any{
+			"id": quality, "codecid": codecId, "codecs": codecs, "baseUrl": url, "backupUrl": backups,
+			"width": width, "height": height, "frameRate": "30", "bandwidth": quality * 25000,
+		}
+	}
+	dashAudio := func(id int, bandwidth int) map[string]any {
+		url, backups := mockMediaUrls(fmt.Sprintf("%d.m4s", id))
+		return map[string]any{"id": id, "codecs": "mp4a.40.2", "baseUrl": url, "backupUrl": backups, "bandwidth": bandwidth}
+	}
+	playInfo := map[string]any{"code": 0, "message": "0", "data": map[string]any{
+		"quality":        80,
+		"accept_quality": []int{80, 64, 32, 16},
+		"dash": map[string]any{
+			"video": []any{
+				dashVideo(80, 7, "avc1.640032", 1920, 1080),
+				dashVideo(80, 12, "hev1.1.6.L120.90", 1920, 1080),
+				dashVideo(64, 7, "avc1.640028", 1280, 720),
+			},
+			"audio": []any{dashAudio(30280, 192000), dashAudio(30216, 64000)},
+		},
+	}}
+
+	stateJson, _ := json.Marshal(initialState)
+	playInfoJson, _ := json.Marshal(playInfo)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><title>%s</title></head><body>`+
+		`<script>window.__playinfo__=%s</script><script>window.__INITIAL_STATE__=%s;(function(){})();</script>`+
+		`</body></html>`, mockTitle, playInfoJson, stateJson)
+}
+
+// servePlayurl answers the playurl API with a FLV stream of the requested
+// quality. Like the real API, it rejects requests without WBI signature.
+func (m *mockBilibili) servePlayurl(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("w_rid") == "" || query.Get("wts") == "" {
+		writeMockJson(w, map[string]any{"code": -403, "message": "访问权限不足"})
+		return
+	}
+	if query.Get("avid") != strconv.Itoa(mockAid) || query.Get("cid") != strconv.Itoa(mockCid) {
+		writeMockJson(w, map[string]any{"code": -404, "message": "啥都木有"})
+		return
+	}
+	qn, _ := strconv.Atoi(query.Get("qn"))
+	if _, ok := streamTypes[qn]; !ok || qn > 64 {
+		qn = 64
+	}
+	name := fmt.Sprintf("%d.flv", qn)
+	url, backups := mockMediaUrls(name)
+	writeMockJson(w, map[string]any{"code": 0, "message": "0", "data": map[string]any{
+		"quality": qn,
+		"format":  streamTypes[qn].Id,
+		"durl": []any{map[string]any{
+			"order": 1, "url": url, "backup_url": backups, "size": len(mockMedia(name)),
+		}},
+	}})
+}
+
+// serveQrPoll answers the first poll as not scanned yet, the second as
+// scanned and the others as confirmed, with the cookies of the session.
+func (m *mockBilibili) serveQrPoll(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("qrcode_key") != "mockkey" {
+		writeMockJson(w, map[string]any{"code": -400, "message": "请求错误"})
+		return
+	}
+	m.mu.Lock()
+	m.qrPolls++
+	polls := m.qrPolls
+	m.mu.Unlock()
+
+	switch polls {
+	case 1:
+		writeMockJson(w, map[string]any{"code": 0, "data": map[string]any{"code": qrCodeNotScanned, "message": "未扫码"}})
+	case 2:
+		writeMockJson(w, map[string]any{"code": 0, "data": map[string]any{"code": qrCodeScanned, "message": "二维码已扫码未确认"}})
+	default:
+		http.SetCookie(w, &http.Cookie{Name: "SESSDATA", Value: "mocksession", Domain: ".bilibili.com", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "bili_jct", Value: "mockcsrf", Domain: ".bilibili.com", Path: "/"})
+		writeMockJson(w, map[string]any{"code": 0, "data": map[string]any{
+			"code": qrCodeSuccess, "message": "", "refresh_token": "mockrefresh",
+		}})
+	}
+}
+
+// waitDownload returns the last progress of a download.
+func waitDownload(progress chan *downloader.Progress) *downloader.Progress {
+	var last *downloader.Progress
+	for p := range progress {
+		last = p
+	}
+	return last
+}
+
+func TestMockGetRegularVideoInfo(t *testing.T) {
+	m := newMockBilibili(t)
+	b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+	infos, err := b.GetResourceInfo()
+	if err != nil {
+		t.Fatalf("GetResourceInfo() returned error: %v", err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expect 1 info, got %d", len(infos))
+	}
+	info := infos[0]
+	if info.Name != mockTitle || info.Id != videoCanonicalId(mockAid, "p1") {
+		t.Errorf("expect %s %s, got %s %s", mockTitle, videoCanonicalId(mockAid, "p1"), info.Name, info.Id)
+	}
+	if info.Metadata.Uploader != "Mock uploader" || info.Metadata.Duration != 2*time.Minute {
+		t.Errorf("unexpected metadata %+v", info.Metadata)
+	}
+
+	sizes := make(map[string]int)
+	for _, s := range info.Streams {
+		sizes[s.Id] = s.Size
+	}
+	video, audio := len(mockMedia("80-7.m4s")), len(mockMedia("30280.m4s"))
+	expected := map[string]int{
+		"dash-flv-avc":    video + audio,
+		"dash-flv-hevc":   video + audio,
+		"dash-flv720-avc": video + audio,
+		"flv720":          len(mockMedia("64.flv")),
+		"flv480":          len(mockMedia("32.flv")),
+		"flv360":          len(mockMedia("16.flv")),
+	}
+	for id, size := range expected {
+		if sizes[id] != size {
+			t.Errorf("expect stream %s of %d bytes, got %d", id, size, sizes[id])
+		}
+	}
+	if len(info.Streams) != len(expected) {
+		t.Errorf("expect %d streams, got %d", len(expected), len(info.Streams))
+	}
+	if len(info.AudioStreams) != 2 || info.AudioStreams[0].Id != "audio-192k" {
+		t.Errorf("expect audio-192k and audio-64k, got %v", info.AudioStreams)
+	}
+	if got := info.Streams[0].Mirrors(0); len(got) != 2 {
+		t.Errorf("expect the backup url of the best stream, got %v", got)
+	}
+	// sizes are probed once per url, without downloading
+	audioPath := fmt.Sprintf("/upgcxcode/01/02/%d/30280.m4s", mockCid)
+	if n := m.requested("HEAD", mockCdnHost, audioPath); n != 1 {
+		t.Errorf("expect the size of the audio to be probed once, got %d", n)
+	}
+	if n := m.requested("GET", mockCdnHost, audioPath); n != 0 {
+		t.Errorf("expect the audio not to be downloaded, got %d requests", n)
+	}
+}
+
+func TestMockDownloadWithRetries(t *testing.T) {
+	m := newMockBilibili(t)
+	m.fail("/x/web-interface/nav", 1)
+	m.throttle("/x/player/wbi/playurl", 1)
+	b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+	b.SetParams(downloader.Params{"format": "flv720"})
+
+	dir := t.TempDir()
+	last := waitDownload(b.Download(0, dir))
+	if last == nil || last.Err != nil {
+		t.Fatalf("expect the download to succeed after retrying, got %+v", last)
+	}
+	if n := m.requested("GET", "api.bilibili.com", "/x/web-interface/nav"); n != 2 {
+		t.Errorf("expect the nav api to be requested twice, got %d", n)
+	}
+
+	name := fmt.Sprintf("%s [%s_p1].flv", mockTitle, AvToBv(mockAid))
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("failed to read the downloaded file: %v", err)
+	}
+	if !bytes.Equal(content, mockMedia("64.flv")) {
+		t.Errorf("downloaded content differs from the media")
+	}
+}
+
+func TestMockDownloadFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		prepare func(m *mockBilibili)
+		fails   bool
+	}{
+		{name: "expired", prepare: func(m *mockBilibili) { m.expire(mockCdnHost) }},
+		// the backup host resumes where the cdn host stopped
+		{name: "truncated", prepare: func(m *mockBilibili) { m.truncate(mockCdnHost) }},
+		{name: "all expired", prepare: func(m *mockBilibili) {
+			m.expire(mockCdnHost)
+			m.expire(mockBackupHost)
+		}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockBilibili(t)
+			b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+			b.SetParams(downloader.Params{"format": "flv480"})
+			if _, err := b.GetResourceInfo(); err != nil {
+				t.Fatalf("GetResourceInfo() returned error: %v", err)
+			}
+			tc.prepare(m)
+
+			dir := t.TempDir()
+			last := waitDownload(b.Download(0, dir))
+			if tc.fails {
+				if last == nil || last.Err == nil || !strings.Contains(last.Err.Error(), "403") {
+					t.Errorf("expect the download to fail with 403, got %+v", last)
+				}
+				return
+			}
+			if last == nil || last.Err != nil {
+				t.Fatalf("expect the download to succeed, got %+v", last)
+			}
+			if n := m.requested("GET", mockBackupHost, fmt.Sprintf("/upgcxcode/01/02/%d/32.flv", mockCid)); n != 1 {
+				t.Errorf("expect the backup host to be requested once, got %d", n)
+			}
+			name := fmt.Sprintf("%s [%s_p1].flv", mockTitle, AvToBv(mockAid))
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("failed to read the downloaded file: %v", err)
+			}
+			if !bytes.Equal(content, mockMedia("32.flv")) {
+				t.Errorf("downloaded content differs from the media")
+			}
+		})
+	}
+}
+
+func TestMockDownloadDashWithAudio(t *testing.T) {
+	m := newMockBilibili(t)
+	merging := utils.FfmpegAvailable()
+	if merging {
+		// ffmpeg only merges real media
+		dir := t.TempDir()
+		video, audio := filepath.Join(dir, "video.mp4"), filepath.Join(dir, "audio.m4a")
+		for _, args := range [][]string{
+			{"-f", "lavfi", "-i", "testsrc=duration=1:size=64x64:rate=10", "-c:v", "mpeg4", video},
+			{"-f", "lavfi", "-i", "sine=duration=1", "-c:a", "aac", audio},
+		} {
+			if out, err := exec.Command("ffmpeg", append([]string{"-y", "-loglevel", "error"}, args...)...).CombinedOutput(); err != nil {
+				t.Skipf("ffmpeg cannot generate test media: %v: %s", err, out)
+			}
+		}
+		for name, path := range map[string]string{"80-7.m4s": video, "30216.m4s": audio} {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read generated media: %v", err)
+			}
+			m.setMedia(name, content)
+		}
+	}
+
+	b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+	// the audio replaces the default audio-192k track of the stream
+	b.SetParams(downloader.Params{"format": "dash-flv-avc", "audio": "audio-64k"})
+	dir := t.TempDir()
+	last := waitDownload(b.Download(0, dir))
+	if last == nil || last.Err != nil {
+		t.Fatalf("expect the download to succeed, got %+v", last)
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%s [%s_p1]", mockTitle, AvToBv(mockAid)))
+	if merging {
+		if _, err := os.Stat(base + ".mp4"); err != nil {
+			t.Errorf("expect the merged file: %v", err)
+		}
+		if _, err := os.Stat(base + ".video.m4s"); !os.IsNotExist(err) {
+			t.Errorf("expect the tracks to be removed after merging, got %v", err)
+		}
+		return
+	}
+	if !strings.Contains(last.Status, "ffmpeg not found") {
+		t.Errorf("expect the status to tell ffmpeg is missing, got %q", last.Status)
+	}
+	for file, name := range map[string]string{".video.m4s": "80-7.m4s", ".audio.m4s": "30216.m4s"} {
+		content, err := os.ReadFile(base + file)
+		if err != nil {
+			t.Fatalf("failed to read track %s: %v", file, err)
+		}
+		if !bytes.Equal(content, mockMedia(name)) {
+			t.Errorf("expect track %s to be %s", file, name)
+		}
+	}
+}
+
+func TestMockQrLogin(t *testing.T) {
+	interval := qrPollInterval
+	qrPollInterval = time.Millisecond
+	defer func() { qrPollInterval = interval }()
+
+	m := newMockBilibili(t)
+	var shown string
+	var statuses []string
+	credential, err := m.newAgent("").QrLogin(func(url string) {
+		shown = url
+	}, func(message string) {
+		statuses = append(statuses, message)
+	})
+	if err != nil {
+		t.Fatalf("QrLogin() returned error: %v", err)
+	}
+	if !strings.Contains(shown, "qrcode_key=mockkey") {
+		t.Errorf("expect the login url to be shown, got %q", shown)
+	}
+	if len(statuses) != 2 {
+		t.Errorf("expect a status for the QR code not scanned then scanned, got %q", statuses)
+	}
+	if credential.Cookie("SESSDATA") != "mocksession" || credential.Cookie("bili_jct") != "mockcsrf" {
+		t.Errorf("expect the cookies of the session, got %v", credential.Cookies)
+	}
+	if credential.RefreshToken != "mockrefresh" {
+		t.Errorf("expect refresh token mockrefresh, got %q", credential.RefreshToken)
+	}
+	// the requests go through the transport of the agent, which sends them
+	// to the mock
+	if n := m.requested("GET", "passport.bilibili.com", "/x/passport-login/web/qrcode/poll"); n != 3 {
+		t.Errorf("expect 3 polls, got %d", n)
+	}
+}
+
+func TestMockProbeErrorsExpire(t *testing.T) {
+	m := newMockBilibili(t)
+	m.expire(mockCdnHost)
+	b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+	url, _ := mockMediaUrls("30280.m4s")
+	path := fmt.Sprintf("/upgcxcode/01/02/%d/30280.m4s", mockCid)
+
+	for range 2 {
+		if _, err := b.getContentLength(url, nil); err == nil {
+			t.Fatalf("expect error for an expired url")
+		}
+	}
+	if n := m.requested("HEAD", mockCdnHost, path); n != 1 {
+		t.Errorf("expect the failure to be cached for a while, got %d probes", n)
+	}
+
+	ttl := probeErrorTtl
+	probeErrorTtl = 0
+	defer func() { probeErrorTtl = ttl }()
+	m.mu.Lock()
+	delete(m.expiredHosts, mockCdnHost)
+	m.mu.Unlock()
+	size, err := b.getContentLength(url, nil)
+	if err != nil || size != len(mockMedia("30280.m4s")) {
+		t.Errorf("expect the size once the failure expired, got %d and error %v", size, err)
+	}
+	if _, err := b.getContentLength(url, nil); err != nil {
+		t.Errorf("expect the size to be cached, got error %v", err)
+	}
+	if n := m.requested("HEAD", mockCdnHost, path); n != 2 {
+		t.Errorf("expect the size to be probed again once, got %d probes", n)
+	}
+}
+
+func TestMockExpiredCookiesContinueAnonymously(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// nav requests failing, the mock answers the others as not logged in
+		navFailures int
+	}{
+		{name: "expired"},
+		{name: "check failed", navFailures: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockBilibili(t)
+			m.fail("/x/web-interface/nav", tc.navFailures)
+			b := m.newAgent("https://www.bilibili.com/video/" + AvToBv(mockAid))
+			b.SetMaxAttempts(1)
+			b.AddCookies(&http.Cookie{Name: "SESSDATA", Value: "expired", Domain: ".bilibili.com"})
+
+			infos, err := b.GetResourceInfo()
+			if err != nil {
+				t.Fatalf("expect the video to be read without login, got error: %v", err)
+			}
+			if len(infos) != 1 || len(infos[0].Streams) == 0 {
+				t.Errorf("expect the streams of the video, got %v", infos)
+			}
+			if b.jar.Value("https://www.bilibili.com/", "SESSDATA") != "" {
+				t.Errorf("expect the cookies to be dropped")
+			}
+		})
+	}
+}
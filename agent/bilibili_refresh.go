@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal/utils"
+)
+
+// Login state checking and cookie refreshing, see
+// https://github.com/SocialSisterYi/bilibili-API-collect/blob/master/docs/login/cookie_refresh.md
+
+// credentialCheckInterval is how often a long-running agent checks whether
+// its cookies are still valid.
+const credentialCheckInterval = 30 * time.Minute
+
+const correspondPublicKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDLgd2OAkcGVtoE3ThUREbio0Eg
+Uc/prcajMKXvkCKFCWhJYJcLkcM2DKKcSeFpD/j6Boy538YXnR6VhcuUJOhH2x71
+nzPjfdTcqMz7djHum0qSZA0AyCBDABUqCrfNgCiJ00Ra7GmRj+YCK1NJEuewlb40
+JNrRuoEUXpabUzGB8QIDAQAB
+-----END PUBLIC KEY-----`
+
+func cookieInfoApiUrl(csrf string) string {
+	return fmt.Sprintf("https://passport.bilibili.com/x/passport-login/web/cookie/info?csrf=%s", csrf)
+}
+
+func correspondUrl(correspondPath string) string {
+	return fmt.Sprintf("https://www.bilibili.com/correspond/1/%s", correspondPath)
+}
+
+func cookieRefreshApiUrl() string {
+	return "https://passport.bilibili.com/x/passport-login/web/cookie/refresh"
+}
+
+func confirmRefreshApiUrl() string {
+	return "https://passport.bilibili.com/x/passport-login/web/confirm/refresh"
+}
+
+// OnCredentialRefresh registers fn to be called with the new credential after
+// the cookies are refreshed, e.g. to save it.
+func (b *Bilibili) OnCredentialRefresh(fn func(*BilibiliCredential)) {
+	b.onCredentialRefresh = fn
+}
+
+// CheckLogin asks the nav API whether the cookies of the agent belong to a
+// logged-in user.
+func (b *Bilibili) CheckLogin() (bool, error) {
+	navJson, err := b.getJsonUncached(navApiUrl(), b.getHeader("", ""))
+	if err != nil {
+		return false, fmt.Errorf("failed to get login state: %v", err)
+	}
+	loggedIn, err := navJson.GetBool("data.isLogin")
+	if err != nil {
+		return false, fmt.Errorf("ill-formated nav api response: %v", err)
+	}
+	return loggedIn, nil
+}
+
+// ensureCredential makes sure that the cookies, if the agent has any, are
+// valid. The cookies are refreshed when the server asks for it and a refresh
+// token is available. Cookies which cannot be checked or refreshed are
+// dropped with a warning and the agent goes on anonymously, as most content
+// does not need a login; what does fails with downloader.ErrCredentialInvalid
+// by itself. The check is done at most once per credentialCheckInterval.
+func (b *Bilibili) ensureCredential() {
+	b.credentialMu.Lock()
+	defer b.credentialMu.Unlock()
+	if b.jar.Value("https://www.bilibili.com/", "SESSDATA") == "" {
+		return
+	}
+	if time.Since(b.credentialCheckedAt) < credentialCheckInterval {
+		return
+	}
+
+	if err := b.checkCredential(); err != nil {
+		warnf("continuing without login: %v", err)
+		b.credential = nil
+		b.jar = utils.NewCookieJar()
+		b.httpClient.SetCookieJar(b.jar)
+	}
+	b.credentialCheckedAt = time.Now()
+}
+
+// checkCredential refreshes the cookies if needed and tells whether they are
+// valid.
+func (b *Bilibili) checkCredential() error {
+	refreshable := b.credential != nil && b.credential.RefreshToken != ""
+	if refreshable {
+		refresh, err := b.needsRefresh()
+		if err != nil {
+			return err
+		}
+		if refresh {
+			if err := b.RefreshCredential(); err != nil {
+				return fmt.Errorf("failed to refresh cookies: %v", err)
+			}
+		}
+	}
+
+	loggedIn, err := b.CheckLogin()
+	if err != nil {
+		return err
+	}
+	if !loggedIn {
+		if !refreshable {
+			return fmt.Errorf("the cookies have expired and cannot be refreshed without refresh token")
+		}
+		return fmt.Errorf("the cookies have expired")
+	}
+	return nil
+}
+
+// needsRefresh asks the server whether the cookies should be refreshed.
+func (b *Bilibili) needsRefresh() (bool, error) {
+	csrf := b.jar.Value("https://www.bilibili.com/", "bili_jct")
+	infoJson, err := b.getJsonUncached(cookieInfoApiUrl(csrf), b.getHeader("", ""))
+	if err != nil {
+		return false, fmt.Errorf("failed to get cookie info: %v", err)
+	}
+	code, err := infoJson.GetInt("code")
+	if err != nil {
+		return false, fmt.Errorf("ill-formated cookie info response: %v", err)
+	}
+	if code == -101 {
+		// not logged in at all, refreshing may still work
+		return true, nil
+	}
+	needed, err := infoJson.GetBool("data.refresh")
+	if err != nil {
+		return false, fmt.Errorf("ill-formated cookie info response: %v", err)
+	}
+	return needed, nil
+}
+
+// RefreshCredential replaces the cookies of the agent with new ones using the
+// refresh token of its credential, and invalidates the old ones.
+func (b *Bilibili) RefreshCredential() error {
+	if b.credential == nil || b.credential.RefreshToken == "" {
+		return fmt.Errorf("no refresh token available")
+	}
+	oldRefreshToken := b.credential.RefreshToken
+
+	correspondPath, err := getCorrespondPath(time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	req := newRequest(correspondUrl(correspondPath), b.getHeader("", ""))
+	resp, err := b.httpClient.Client().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get refresh csrf: %v", err)
+	}
+	html, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read refresh csrf response: %v", err)
+	}
+	match := regexp.MustCompile(`<div id="1-name">([^<]+)</div>`).FindSubmatch(html)
+	if match == nil {
+		return fmt.Errorf("refresh csrf not found in response")
+	}
+	refreshCsrf := strings.TrimSpace(string(match[1]))
+
+	form := url.Values{
+		"csrf":          {b.jar.Value("https://www.bilibili.com/", "bili_jct")},
+		"refresh_csrf":  {refreshCsrf},
+		"source":        {"main_web"},
+		"refresh_token": {oldRefreshToken},
+	}
+	refreshJson, err := b.postForm(cookieRefreshApiUrl(), form)
+	if err != nil {
+		return fmt.Errorf("failed to refresh cookies: %v", err)
+	}
+	newRefreshToken, err := refreshJson.GetString("data.refresh_token")
+	if err != nil {
+		return fmt.Errorf("ill-formated cookie refresh response: %v", err)
+	}
+
+	// the new cookies are in the jar now, confirm them to invalidate the old ones
+	form = url.Values{
+		"csrf":          {b.jar.Value("https://www.bilibili.com/", "bili_jct")},
+		"refresh_token": {oldRefreshToken},
+	}
+	if _, err := b.postForm(confirmRefreshApiUrl(), form); err != nil {
+		return fmt.Errorf("failed to confirm refreshed cookies: %v", err)
+	}
+
+	b.credential = &BilibiliCredential{Cookies: b.jar.All(), RefreshToken: newRefreshToken}
+	if b.onCredentialRefresh != nil {
+		b.onCredentialRefresh(b.credential)
+	}
+	return nil
+}
+
+// getCorrespondPath encrypts "refresh_<timestamp>" with the public key of
+// Bilibili, as the web client does.
+func getCorrespondPath(timestamp int64) (string, error) {
+	block, _ := pem.Decode([]byte(correspondPublicKey))
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.(*rsa.PublicKey),
+		[]byte("refresh_"+strconv.FormatInt(timestamp, 10)), nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(encrypted), nil
+}
+
+// getJsonUncached sends a GET request bypassing the cache, for APIs whose
+// answer changes over time.
+func (b *Bilibili) getJsonUncached(url string, header map[string]string) (*utils.JsonNode, error) {
+	url, err := b.signUrl(url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.httpClient.Client().Do(newRequest(url, header))
+	if err != nil {
+		return nil, fmt.Errorf("GET request got error: %v", err)
+	}
+	j, err := decodeJsonResponse(resp)
+	if err == nil && isWbiUrl(url) {
+		if code, err := j.GetInt("code"); err == nil && isWbiRejected(code) {
+			b.wbi.invalidate()
+		}
+	}
+	return j, err
+}
+
+// postForm sends a form and returns the json response, which must have code 0.
+func (b *Bilibili) postForm(url string, form url.Values) (*utils.JsonNode, error) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	for k, v := range b.getHeader("", "") {
+		req.Header.Add(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := b.httpClient.Client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("POST request got error: %v", err)
+	}
+	j, err := decodeJsonResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if code, err := j.GetInt("code"); err != nil || code != 0 {
+		message, _ := j.GetString("message")
+		return nil, fmt.Errorf("api returned code %d: %s", code, message)
+	}
+	return j, nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"internal/utils"
+
+	"downloader"
+)
+
+// getUgcSeason returns the id and the title of the uploader season a regular
+// video belongs to.
+func getUgcSeason(initialState *utils.JsonNode) (string, string) {
+	id, _ := initialState.GetInt("videoData.ugc_season.id")
+	title, _ := initialState.GetString("videoData.ugc_season.title")
+	return strconv.Itoa(id), title
+}
+
+// getUgcSeasonEpisodes expands a video into every episode of its uploader
+// season, in the order of the season, and episodes having several parts into
+// every part. Streams of the episodes are resolved when they are downloaded.
+func (b *Bilibili) getUgcSeasonEpisodes(initialState *utils.JsonNode) ([]downloader.ResourceInfo, error) {
+	seasonId, seasonTitle := getUgcSeason(initialState)
+	sections, err := initialState.GetArray("videoData.ugc_season.sections")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sections of season %s: %v", seasonId, err)
+	}
+
+	resources := make([]downloader.ResourceInfo, 0)
+	number := 0
+	for i, section := range sections {
+		episodes, err := utils.NewJsonNode(section).GetArray("episodes")
+		if err != nil {
+			warnf("skipping section %d of season %s: %v", i+1, seasonId, err)
+			continue
+		}
+		for _, elem := range episodes {
+			number++
+			episode := utils.NewJsonNode(elem)
+			avid, err := episode.GetInt("aid")
+			if err != nil {
+				warnf("skipping episode %d of season %s: %v", number, seasonId, err)
+				continue
+			}
+			title, _ := episode.GetString("title")
+			parts := getEpisodeParts(episode)
+			if len(parts) == 0 {
+				warnf("skipping episode %d of season %s: no cid found", number, seasonId)
+				continue
+			}
+
+			for _, part := range parts {
+				info := downloader.ResourceInfo{
+					Id:   videoCanonicalId(avid, fmt.Sprintf("p%d", part.page)),
+					Site: "Bilibili",
+					Name: title,
+					Url:  fmt.Sprintf("https://www.bilibili.com/video/%s", AvToBv(int64(avid))),
+					Type: downloader.RT_Video,
+					Others: map[string]string{
+						"avid": strconv.Itoa(avid),
+						"cid":  strconv.Itoa(part.cid),
+					},
+				}
+				if len(parts) > 1 {
+					info.Name = fmt.Sprintf("%s (P%d. %s)", title, part.page, part.title)
+					info.Url += fmt.Sprintf("?p=%d", part.page)
+				}
+				info.Metadata.Season = seasonTitle
+				info.Metadata.SeasonId = seasonId
+				info.Metadata.Episode = number
+				info.Metadata.Cover, _ = episode.GetString("arc.pic")
+				info.Metadata.Duration = part.duration
+				resources = append(resources, info)
+			}
+		}
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("season %s has no episodes", seasonId)
+	}
+
+	b.infoAcquired = true
+	b.resourceInfos = downloader.Dedup(resources)
+	return b.resourceInfos, nil
+}
+
+type episodePart struct {
+	cid      int
+	page     int
+	title    string
+	duration time.Duration
+}
+
+// getEpisodeParts returns the parts of an episode of a season. Episodes
+// without the list of their parts have a single one, with the cid of the
+// episode.
+func getEpisodeParts(episode *utils.JsonNode) []episodePart {
+	duration, _ := episode.GetInt("arc.duration")
+	pages, _ := episode.GetArray("pages")
+	if len(pages) == 0 {
+		cid, err := episode.GetInt("cid")
+		if err != nil {
+			return nil
+		}
+		return []episodePart{{cid: cid, page: 1, duration: time.Duration(duration) * time.Second}}
+	}
+
+	parts := make([]episodePart, 0, len(pages))
+	for i, elem := range pages {
+		page := utils.NewJsonNode(elem)
+		cid, err := page.GetInt("cid")
+		if err != nil {
+			aid, _ := episode.GetInt("aid")
+			warnf("skipping part %d of av%d: %v", i+1, aid, err)
+			continue
+		}
+		part := episodePart{cid: cid, page: i + 1}
+		if p, err := page.GetInt("page"); err == nil {
+			part.page = p
+		}
+		part.title, _ = page.GetString("part")
+		if d, err := page.GetInt("duration"); err == nil {
+			part.duration = time.Duration(d) * time.Second
+		} else {
+			part.duration = time.Duration(duration) * time.Second
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
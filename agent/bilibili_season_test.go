@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"internal/utils"
+	"testing"
+	"time"
+)
+
+func TestGetUgcSeasonEpisodes(t *testing.T) {
+	initialState, err := utils.UnmarshalJson([]byte(`{"videoData": {"ugc_season": {
+		"id": 7, "title": "Mock season",
+		"sections": [{"episodes": [
+			{"aid": 170001, "cid": 1, "title": "Two parts", "arc": {"duration": 300},
+				"pages": [
+					{"cid": 1, "page": 1, "part": "Intro", "duration": 100},
+					{"cid": 2, "page": 2, "part": "Main", "duration": 200}
+				]},
+			{"aid": 170002, "cid": 3, "title": "No pages", "arc": {"duration": 60}}
+		]}]
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := NewBilibili("", "").getUgcSeasonEpisodes(initialState)
+	if err != nil {
+		t.Fatalf("getUgcSeasonEpisodes() returned error: %v", err)
+	}
+
+	expected := []struct {
+		id       string
+		name     string
+		cid      string
+		episode  int
+		duration time.Duration
+	}{
+		{videoCanonicalId(170001, "p1"), "Two parts (P1. Intro)", "1", 1, 100 * time.Second},
+		{videoCanonicalId(170001, "p2"), "Two parts (P2. Main)", "2", 1, 200 * time.Second},
+		{videoCanonicalId(170002, "p1"), "No pages", "3", 2, 60 * time.Second},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("expect %d resources, got %d", len(expected), len(infos))
+	}
+	for i, e := range expected {
+		info := infos[i]
+		if info.Id != e.id || info.Name != e.name || info.Others["cid"] != e.cid {
+			t.Errorf("expect %s %q with cid %s, got %s %q with cid %s", e.id, e.name, e.cid, info.Id, info.Name, info.Others["cid"])
+		}
+		if info.Metadata.Episode != e.episode || info.Metadata.Duration != e.duration || info.Metadata.Season != "Mock season" {
+			t.Errorf("unexpected metadata of %s: %+v", e.id, info.Metadata)
+		}
+	}
+}
@@ -2,12 +2,48 @@ package agent
 
 import (
 	"downloader"
+	"flag"
+	"internal/utils"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+var record = flag.Bool("record", false, "record the fixtures in testdata from the live sites")
+
+// newTestBilibili creates an agent answered by the fixture testdata/<name>.json,
+// see utils.Fixture. With -record the agent talks to the live sites and the
+// fixture is recorded again. Tests fail if their fixture has not been
+// recorded, the fixtures are committed with the tests.
+func newTestBilibili(t *testing.T, url string, name string) *Bilibili {
+	t.Helper()
+	path := filepath.Join("testdata", name+".json")
+	if *record {
+		fixture := &utils.Fixture{}
+		t.Cleanup(func() {
+			if err := fixture.Save(path); err != nil {
+				t.Errorf("failed to save fixture %s: %v", path, err)
+			}
+		})
+		return NewBilibiliWithOptions(url, "", downloader.AgentOptions{Transport: fixture.Recorder(http.DefaultTransport)})
+	}
+
+	fixture, err := utils.LoadFixture(path)
+	if err != nil {
+		t.Fatalf("no fixture %s, record it with go test -run %s -record: %v", path, t.Name(), err)
+	}
+	b := NewBilibiliWithOptions(url, "", downloader.AgentOptions{Transport: fixture.Replayer()})
+	// nothing to be polite to
+	b.SetRateLimit("*", 0)
+	b.SetMaxAttempts(1)
+	return b
+}
+
 func TestGetVideoInfo(t *testing.T) {
 	url := "https://www.bilibili.com/video/BV18J4m1n7To/?spm_id_from=333.999.list.card_archive.click&vd_source=37a28a610e3356e763e08ec5ebb1d310"
-	bilibili := NewBilibili(url, "")
+	bilibili := newTestBilibili(t, url, "video")
 	infos, err := bilibili.GetResourceInfo()
 	if err != nil {
 		t.Fatalf("bilibili.GetVideoInfo() returned error: %v", err)
@@ -22,7 +58,54 @@ func TestGetVideoInfo(t *testing.T) {
 	if info.Type != downloader.RT_Video {
 		t.Errorf("expect RT_Video, got %v", info.Type)
 	}
-	if len(info.Streams) != 2 {
-		t.Errorf("expect 2 streams, got %d", len(info.Streams))
+	// every DASH codec is a separate stream, so there are at least as many
+	// streams as qualities.
+	if len(info.Streams) < 2 {
+		t.Errorf("expect at least 2 streams, got %d", len(info.Streams))
+	}
+	for _, s := range info.Streams {
+		if strings.HasPrefix(s.Id, "dash-") && (s.Codec == "" || s.Resolution[1] == 0) {
+			t.Errorf("expect codec and resolution of stream %s, got %q and %v", s.Id, s.Codec, s.Resolution)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNewBilibiliWithOptions(t *testing.T) {
+	var got *http.Request
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})
+	b := NewBilibiliWithOptions("", "", downloader.AgentOptions{
+		Transport: transport,
+		UserAgent: "test-agent",
+		Header:    map[string]string{"Accept-Language": "zh-CN", "Referer": "", "X-Test": "1"},
+	})
+	if _, err := b.getContent("https://api.bilibili.com/x/test", b.getHeader("https://www.bilibili.com/", "")); err != nil {
+		t.Fatalf("getContent() returned error: %v", err)
+	}
+	if got == nil {
+		t.Fatalf("expect the request to go through the transport")
+	}
+	if ua := got.Header.Get("User-Agent"); ua != "test-agent" {
+		t.Errorf("expect the user agent of the options, got %q", ua)
+	}
+	if lang := got.Header.Get("Accept-Language"); lang != "zh-CN" {
+		t.Errorf("expect the overridden Accept-Language, got %q", lang)
+	}
+	if referer := got.Header.Get("Referer"); referer != "" {
+		t.Errorf("expect the referer to be removed, got %q", referer)
+	}
+	if got.Header.Get("X-Test") != "1" {
+		t.Errorf("expect the added header")
+	}
+	if err := b.SetProxy("*", "http://127.0.0.1:8080"); err == nil {
+		t.Errorf("expect error setting proxies with a custom transport")
 	}
 }
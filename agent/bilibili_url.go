@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var avPathRegex = regexp.MustCompile(`^/video/[aA][vV](\d+)(/.*)?$`)
+
+var shortLinkRegex = regexp.MustCompile(`^(https?://)?(b23\.tv|bili2233\.cn)/`)
+
+// trackingQueryParams only track where a link came from, unlike the other
+// parameters which may select content, e.g. "p" or "t". Parameters starting
+// with "share_" are tracking ones as well.
+var trackingQueryParams = map[string]bool{
+	"spm_id_from": true, "from_spmid": true, "vd_source": true, "from": true, "from_source": true,
+	"buvid": true, "bbid": true, "unique_k": true, "plat_id": true, "is_story_h5": true,
+	"ts": true, "timestamp": true, "seid": true, "broadcast_type": true, "is_room_feed": true,
+}
+
+func isTrackingQueryParam(key string) bool {
+	return trackingQueryParams[key] || strings.HasPrefix(key, "share_")
+}
+
+// resolveUrl follows short links like "https://b23.tv/xxxx" and normalizes the
+// result, see normalizeUrl.
+func (b *Bilibili) resolveUrl(rawUrl string) (string, error) {
+	if shortLinkRegex.MatchString(rawUrl) {
+		if !strings.HasPrefix(rawUrl, "http") {
+			rawUrl = "https://" + rawUrl
+		}
+		resp, err := b.httpClient.Client().Do(newRequest(rawUrl, b.getHeader("", "")))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve short link %s: %v", rawUrl, err)
+		}
+		resp.Body.Close()
+		rawUrl = resp.Request.URL.String()
+		if shortLinkRegex.MatchString(rawUrl) {
+			return "", fmt.Errorf("short link %s does not redirect", rawUrl)
+		}
+	}
+	return normalizeUrl(rawUrl)
+}
+
+// normalizeUrl turns mobile urls into their desktop counterparts and removes
+// tracking parameters, e.g.
+// "https://m.bilibili.com/video/BV1xx411c7mD?share_source=copy" becomes
+// "https://www.bilibili.com/video/BV1xx411c7mD".
+func normalizeUrl(rawUrl string) (string, error) {
+	if !strings.HasPrefix(rawUrl, "http") {
+		rawUrl = "https://" + rawUrl
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %s: %v", rawUrl, err)
+	}
+	u.Scheme = "https"
+
+	switch u.Host {
+	case "m.bilibili.com", "bilibili.com":
+		u.Host = "www.bilibili.com"
+	case "live.bilibili.com":
+		// https://live.bilibili.com/h5/123
+		u.Path = strings.TrimPrefix(u.Path, "/h5")
+	}
+	if u.Host == "www.bilibili.com" {
+		// https://m.bilibili.com/space/123
+		if mid, found := strings.CutPrefix(u.Path, "/space/"); found {
+			u.Host = "space.bilibili.com"
+			u.Path = "/" + mid
+		}
+		// the same video is reachable by av and bv id, use the bv id
+		if match := avPathRegex.FindStringSubmatch(u.Path); match != nil {
+			if aid, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+				u.Path = "/video/" + AvToBv(aid) + match[2]
+			}
+		}
+	}
+
+	query := u.Query()
+	for k := range query {
+		if isTrackingQueryParam(k) {
+			query.Del(k)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,23 @@
+package agent
+
+import "testing"
+
+func TestNormalizeUrl(t *testing.T) {
+	cases := map[string]string{
+		"https://m.bilibili.com/video/BV18J4m1n7To?share_source=copy_web&vd_source=abc": "https://www.bilibili.com/video/BV18J4m1n7To",
+		"www.bilibili.com/video/BV18J4m1n7To/?p=2&spm_id_from=333.999":                  "https://www.bilibili.com/video/BV18J4m1n7To/?p=2",
+		"http://bilibili.com/video/av170001":                                            "https://www.bilibili.com/video/BV17x411w7KC",
+		"https://m.bilibili.com/space/2":                                                "https://space.bilibili.com/2",
+		"https://live.bilibili.com/h5/21452505?broadcast_type=0":                        "https://live.bilibili.com/21452505",
+		// parameters not known to be tracking ones are kept
+		"https://www.bilibili.com/list/2?sid=123&oid=456&share_medium=android&unique_k=x": "https://www.bilibili.com/list/2?oid=456&sid=123",
+	}
+	for input, expected := range cases {
+		got, err := normalizeUrl(input)
+		if err != nil {
+			t.Errorf("normalizeUrl(%s) returned error: %v", input, err)
+		} else if got != expected {
+			t.Errorf("normalizeUrl(%s): expect %s, got %s", input, expected, got)
+		}
+	}
+}
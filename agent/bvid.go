@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"downloader"
+)
+
+// AV/BV id conversion, see
+// https://github.com/SocialSisterYi/bilibili-API-collect/blob/master/docs/misc/bvid_desc.md
+
+const (
+	bvXorCode  = 23442827791579
+	bvMaskCode = 2251799813685247
+	bvMaxAid   = 1 << 51
+	bvAlphabet = "FcwAPNKTMug3GV5Lj7EJnHpWsx4tb8haYeviqBz6rkCy12mUSDQX9RdoZf"
+	bvBase     = 58
+)
+
+// AvToBv converts an av id, e.g. 170001, to its bv id, e.g. "BV17x411w7KC".
+func AvToBv(aid int64) string {
+	bytes := []byte("BV1000000000")
+	tmp := (bvMaxAid | aid) ^ bvXorCode
+	for i := len(bytes) - 1; tmp > 0; i-- {
+		bytes[i] = bvAlphabet[tmp%bvBase]
+		tmp /= bvBase
+	}
+	bytes[3], bytes[9] = bytes[9], bytes[3]
+	bytes[4], bytes[7] = bytes[7], bytes[4]
+	return string(bytes)
+}
+
+// BvToAv converts a bv id, e.g. "BV17x411w7KC", to its av id, e.g. 170001.
+func BvToAv(bvid string) (int64, error) {
+	if len(bvid) != 12 || !strings.EqualFold(bvid[:3], "BV1") {
+		return 0, fmt.Errorf("invalid bv id %s", bvid)
+	}
+	bytes := []byte(bvid)
+	bytes[3], bytes[9] = bytes[9], bytes[3]
+	bytes[4], bytes[7] = bytes[7], bytes[4]
+	var tmp int64
+	for _, c := range bytes[3:] {
+		idx := strings.IndexByte(bvAlphabet, c)
+		if idx < 0 {
+			return 0, fmt.Errorf("invalid bv id %s", bvid)
+		}
+		tmp = tmp*bvBase + int64(idx)
+	}
+	return (tmp & bvMaskCode) ^ bvXorCode, nil
+}
+
+// videoCanonicalId returns the canonical id of a part of a video, using the bv
+// id however the video was reached.
+func videoCanonicalId(avid int, part string) string {
+	return downloader.CanonicalId("Bilibili", "video", AvToBv(int64(avid)), part)
+}
@@ -0,0 +1,24 @@
+package agent
+
+import "testing"
+
+func TestAvBvConversion(t *testing.T) {
+	cases := map[int64]string{
+		170001:     "BV17x411w7KC",
+		1054803170: "BV1mH4y1u7UA",
+	}
+	for aid, bvid := range cases {
+		if got := AvToBv(aid); got != bvid {
+			t.Errorf("AvToBv(%d): expect %s, got %s", aid, bvid, got)
+		}
+		got, err := BvToAv(bvid)
+		if err != nil {
+			t.Errorf("BvToAv(%s) returned error: %v", bvid, err)
+		} else if got != aid {
+			t.Errorf("BvToAv(%s): expect %d, got %d", bvid, aid, got)
+		}
+	}
+	if _, err := BvToAv("BV17x411w7K"); err == nil {
+		t.Errorf("expect error for a short bv id")
+	}
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"internal/utils"
+)
+
+// WBI signing, required by the web APIs under ".../wbi/...".
+// The signature is the md5 of the sorted query string followed by a mixin key
+// derived from two keys published by the nav API.
+
+var mixinKeyEncTab = []int{
+	46, 47, 18, 2, 53, 8, 23, 32, 15, 50, 10, 31, 58, 3, 45, 35, 27, 43, 5, 49,
+	33, 9, 42, 19, 29, 28, 14, 39, 12, 38, 41, 13, 37, 48, 7, 16, 24, 55, 40,
+	61, 26, 17, 0, 1, 60, 51, 30, 4, 22, 25, 54, 21, 56, 59, 6, 63, 57, 62, 11,
+	36, 20, 34, 44, 52,
+}
+
+// wbiKeyTTL is how long the keys from the nav API are reused. They are
+// rotated daily by the server.
+const wbiKeyTTL = time.Hour
+
+func navApiUrl() string {
+	return "https://api.bilibili.com/x/web-interface/nav"
+}
+
+func isWbiUrl(u string) bool {
+	return strings.Contains(u, "/wbi/") || strings.Contains(u, "/web-room/v1/index/getDanmuInfo")
+}
+
+type wbiSigner struct {
+	mu        sync.Mutex
+	mixinKey  string
+	fetchedAt time.Time
+	now       func() time.Time
+}
+
+func newWbiSigner() *wbiSigner {
+	return &wbiSigner{now: time.Now}
+}
+
+// sign appends "wts" and "w_rid" to the query of rawUrl. fetchNav is used to
+// get the response of the nav API when the cached keys are missing or stale.
+func (s *wbiSigner) sign(rawUrl string, fetchNav func() ([]byte, error)) (string, error) {
+	mixinKey, err := s.getMixinKey(fetchNav)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Del("w_rid")
+	query.Set("wts", strconv.FormatInt(s.now().Unix(), 10))
+	for k, values := range query {
+		for i, v := range values {
+			values[i] = strings.Map(func(r rune) rune {
+				if strings.ContainsRune("!'()*", r) {
+					return -1
+				}
+				return r
+			}, v)
+		}
+		query[k] = values
+	}
+	// Encode sorts by key. It writes spaces as "+" where encodeURIComponent,
+	// which the signature is defined with, writes "%20"; a literal "+" is
+	// "%2B" in both.
+	encoded := strings.ReplaceAll(query.Encode(), "+", "%20")
+	hash := md5.Sum([]byte(encoded + mixinKey))
+	u.RawQuery = encoded + "&w_rid=" + hex.EncodeToString(hash[:])
+	return u.String(), nil
+}
+
+// invalidate drops the keys, so the next signature fetches them again. It is
+// for responses telling the signature is wrong, which happens when the
+// server rotated its keys before wbiKeyTTL.
+func (s *wbiSigner) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mixinKey = ""
+}
+
+// wbi codes of responses to requests with a wrong or outdated signature
+func isWbiRejected(code int) bool {
+	return code == -352 || code == -403
+}
+
+func (s *wbiSigner) getMixinKey(fetchNav func() ([]byte, error)) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mixinKey != "" && s.now().Sub(s.fetchedAt) < wbiKeyTTL {
+		return s.mixinKey, nil
+	}
+
+	content, err := fetchNav()
+	if err != nil {
+		return "", fmt.Errorf("failed to get wbi keys: %v", err)
+	}
+	navJson, err := utils.UnmarshalJson(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse nav api response as json: %v", err)
+	}
+	// the keys are present even if the user is not logged in
+	imgUrl, err := navJson.GetString("data.wbi_img.img_url")
+	if err != nil {
+		return "", fmt.Errorf("failed to get wbi img key: %v", err)
+	}
+	subUrl, err := navJson.GetString("data.wbi_img.sub_url")
+	if err != nil {
+		return "", fmt.Errorf("failed to get wbi sub key: %v", err)
+	}
+
+	s.mixinKey = wbiMixinKey(wbiKeyFromUrl(imgUrl) + wbiKeyFromUrl(subUrl))
+	s.fetchedAt = s.now()
+	return s.mixinKey, nil
+}
+
+// wbiKeyFromUrl extracts the key from urls like
+// "https://i0.hdslb.com/bfs/wbi/7cd084941338484aae1ad9425b84077c.png".
+func wbiKeyFromUrl(u string) string {
+	base := path.Base(u)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+func wbiMixinKey(orig string) string {
+	var sb strings.Builder
+	for _, i := range mixinKeyEncTab {
+		if i < len(orig) {
+			sb.WriteByte(orig[i])
+		}
+	}
+	key := sb.String()
+	if len(key) > 32 {
+		key = key[:32]
+	}
+	return key
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWbiSign(t *testing.T) {
+	nav := `{"code":-101,"data":{"isLogin":false,"wbi_img":{
+		"img_url":"https://i0.hdslb.com/bfs/wbi/7cd084941338484aae1ad9425b84077c.png",
+		"sub_url":"https://i0.hdslb.com/bfs/wbi/4932caff0ff746eab6f01bf08b70ac45.png"}}}`
+	fetched := 0
+	fetchNav := func() ([]byte, error) {
+		fetched++
+		return []byte(nav), nil
+	}
+	signer := newWbiSigner()
+	signer.now = func() time.Time { return time.Unix(1702204169, 0) }
+
+	signed, err := signer.sign("https://api.bilibili.com/x/wbi/test?foo=114&bar=514&zab=1919810", fetchNav)
+	if err != nil {
+		t.Fatalf("sign() returned error: %v", err)
+	}
+	expected := "https://api.bilibili.com/x/wbi/test?bar=514&foo=114&wts=1702204169&zab=1919810&w_rid=8f6f2b5b3d485fe1886cec6a0be8c5d4"
+	if signed != expected {
+		t.Errorf("expect %s, got %s", expected, signed)
+	}
+	if signer.mixinKey != "ea1db124af3c7062474693fa704f4ff8" {
+		t.Errorf("expect mixin key ea1db124af3c7062474693fa704f4ff8, got %s", signer.mixinKey)
+	}
+
+	if _, err := signer.sign("https://api.bilibili.com/x/wbi/test?foo=1", fetchNav); err != nil {
+		t.Fatalf("sign() returned error: %v", err)
+	}
+	if fetched != 1 {
+		t.Errorf("expect keys to be fetched once, got %d", fetched)
+	}
+
+	// spaces are signed as "%20", like encodeURIComponent writes them
+	signed, err = signer.sign("https://api.bilibili.com/x/web-interface/wbi/search/type?search_type=video&keyword=hello+world", fetchNav)
+	if err != nil {
+		t.Fatalf("sign() returned error: %v", err)
+	}
+	expected = "https://api.bilibili.com/x/web-interface/wbi/search/type?keyword=hello%20world&search_type=video&wts=1702204169&w_rid=eb41e2935e6aed54b62c2244b211fbe1"
+	if signed != expected {
+		t.Errorf("expect %s, got %s", expected, signed)
+	}
+
+	signer.invalidate()
+	if _, err := signer.sign("https://api.bilibili.com/x/wbi/test?foo=1", fetchNav); err != nil {
+		t.Fatalf("sign() returned error: %v", err)
+	}
+	if fetched != 2 {
+		t.Errorf("expect keys to be fetched again once invalidated, got %d", fetched)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"agent"
+	"downloader"
+	"fmt"
+	"internal/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newBilibili creates the Bilibili agent with the cookies given by --sessdata,
+// --cookies or the stored credential, and the network flags, see
+// configureNetwork.
+func newBilibili(url string, flags map[string]string) *agent.Bilibili {
+	bilibili := agent.NewBilibiliWithOptions(url, flags["sessdata"], agentOptions(flags))
+	if flags["sessdata"] == "" {
+		if credential := loadBilibiliCredential(flags); credential != nil {
+			bilibili.SetCredential(credential)
+			bilibili.OnCredentialRefresh(func(c *agent.BilibiliCredential) {
+				saveBilibiliCredential(flags, c)
+			})
+		}
+	}
+	if path := flags["cookies"]; path != "" {
+		cookies, err := utils.LoadCookieFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load cookies from %s. Error is: %v\n", path, err)
+			os.Exit(106)
+		}
+		bilibili.AddCookies(cookies...)
+	}
+	configureNetwork(bilibili, flags)
+	setupCache(bilibili, flags)
+	return bilibili
+}
+
+// agentOptions returns the options of the agents, with the user agent given
+// by --user-agent.
+func agentOptions(flags map[string]string) downloader.AgentOptions {
+	return downloader.AgentOptions{UserAgent: flags["user-agent"]}
+}
+
+// configureNetwork applies --max-attempts, --rate-limit and --proxy to the
+// agent.
+func configureNetwork(bilibili *agent.Bilibili, flags map[string]string) {
+	if n := flags["max-attempts"]; n != "" {
+		attempts, err := strconv.Atoi(n)
+		if err != nil || attempts < 1 {
+			fmt.Fprintf(os.Stderr, "--max-attempts must be a positive integer, got %q\n", n)
+			usageAndExit(1)
+		}
+		bilibili.SetMaxAttempts(attempts)
+	}
+	if limits := flags["rate-limit"]; limits != "" {
+		rules, err := parseRateLimits(limits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usageAndExit(1)
+		}
+		for _, r := range rules {
+			bilibili.SetRateLimit(r.pattern, r.rate)
+		}
+	}
+	if proxies := flags["proxy"]; proxies != "" {
+		for _, part := range strings.Split(proxies, ",") {
+			pattern, proxy := parseProxy(strings.TrimSpace(part))
+			if err := bilibili.SetProxy(pattern, proxy); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				usageAndExit(1)
+			}
+		}
+	}
+}
+
+// parseProxy parses an entry of --proxy, either a proxy url for every host,
+// or "<host pattern>=<proxy url>", where the url may also be "direct".
+func parseProxy(s string) (pattern string, proxy string) {
+	if i, j := strings.Index(s, "://"), strings.Index(s, "="); s == "direct" || j < 0 || (i >= 0 && i < j) {
+		return "*", s
+	}
+	pattern, proxy, _ = strings.Cut(s, "=")
+	return pattern, proxy
+}
+
+type rateLimit struct {
+	pattern string
+	rate    float64
+}
+
+// parseRateLimits parses --rate-limit, a comma separated list of requests
+// per second for host patterns like "api.bilibili.com=2" or
+// "*.bilibili.com=4". A rate without pattern applies to every host.
+func parseRateLimits(s string) ([]rateLimit, error) {
+	limits := make([]rateLimit, 0)
+	for _, part := range strings.Split(s, ",") {
+		pattern, rate, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			pattern, rate = "*", pattern
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r < 0 || pattern == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, expect [<host pattern>=]<requests per second>", part)
+		}
+		limits = append(limits, rateLimit{pattern: pattern, rate: r})
+	}
+	return limits, nil
+}
+
+// credentialPath returns the file given by --credential, or the default one.
+func credentialPath(flags map[string]string) string {
+	if path := flags["credential"]; path != "" {
+		return path
+	}
+	path, err := agent.DefaultBilibiliCredentialPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot determine where to store credentials, use --credential. Error is: %v\n", err)
+		os.Exit(103)
+	}
+	return path
+}
+
+// loadBilibiliCredential returns the stored credential, or nil if there is none.
+func loadBilibiliCredential(flags map[string]string) *agent.BilibiliCredential {
+	path := credentialPath(flags)
+	credential, err := agent.LoadBilibiliCredential(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Ignoring credential file %s. Error is: %v\n", path, err)
+		}
+		return nil
+	}
+	return credential
+}
+
+func login(flags map[string]string) {
+	// without the cookies of newBilibili, which the login replaces
+	bilibili := agent.NewBilibiliWithOptions("", "", agentOptions(flags))
+	configureNetwork(bilibili, flags)
+	credential, err := bilibili.QrLogin(func(url string) {
+		qr, err := utils.NewQrCode([]byte(url))
+		if err != nil {
+			fmt.Printf("Open this url on the Bilibili app to log in:\n%s\n", url)
+			return
+		}
+		fmt.Println("Scan the QR code with the Bilibili app to log in:")
+		fmt.Print(qr.String())
+	}, func(message string) {
+		fmt.Println(message)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to log in. Error is: %v\n", err)
+		os.Exit(104)
+	}
+
+	path := saveBilibiliCredential(flags, credential)
+	fmt.Printf("Logged in. Credential saved to %s\n", path)
+}
+
+// saveBilibiliCredential stores credential where loadBilibiliCredential finds
+// it, and returns the path.
+func saveBilibiliCredential(flags map[string]string, credential *agent.BilibiliCredential) string {
+	path := credentialPath(flags)
+	if err := credential.Save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save credential to %s. Error is: %v\n", path, err)
+		os.Exit(105)
+	}
+	return path
+}
+
+func credentialInvalidAndExit(err error) {
+	fmt.Fprintf(os.Stderr, "The login credential is no longer valid. Run \"%s login\" to log in again. Error is: %v\n", os.Args[0], err)
+	os.Exit(107)
+}
+
+func whoami(url string, flags map[string]string) {
+	account, err := newBilibili(url, flags).WhoAmI()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get account information. Error is: %v\n", err)
+		os.Exit(108)
+	}
+	if !account.LoggedIn {
+		fmt.Println("Not logged in.")
+	} else {
+		fmt.Printf("Uid:                        %d\n", account.Uid)
+		fmt.Printf("Name:                       %s\n", account.Name)
+		fmt.Printf("Level:                      %d\n", account.Level)
+		switch {
+		case !account.VipActive:
+			fmt.Println("VIP:                        no")
+		default:
+			label := account.VipLabel
+			if label == "" {
+				label = map[int]string{1: "monthly", 2: "annual"}[account.VipType]
+			}
+			fmt.Printf("VIP:                        %s, expires at %s\n", label, account.VipExpiry.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	if account.Qualities == nil {
+		return
+	}
+	fmt.Println("Qualities of the sample video:")
+	for _, q := range agent.PremiumQualities() {
+		obtainable, offered := account.Qualities[q]
+		var state string
+		switch {
+		case !offered:
+			state = "not offered by the video"
+		case obtainable:
+			state = "obtainable"
+		default:
+			state = "not obtainable"
+		}
+		fmt.Printf("  - [%d] %s: %s\n", q, agent.QualityDesc(q), state)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"agent"
+	"fmt"
+	"internal/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cacheDir returns the directory given by --cache-dir, or the default one.
+func cacheDir(flags map[string]string) string {
+	if dir := flags["cache-dir"]; dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot determine where to cache responses, use --cache-dir. Error is: %v\n", err)
+		os.Exit(110)
+	}
+	return filepath.Join(dir, "downloader", "http")
+}
+
+// cacheEnabled tells whether responses are kept on disk across runs, which
+// --cache or --cache-dir turn on.
+func cacheEnabled(flags map[string]string) bool {
+	_, cache := flags["cache"]
+	_, dir := flags["cache-dir"]
+	return cache || dir
+}
+
+// setupCache applies --no-cache, --cache-limits and the flags of
+// cacheEnabled.
+func setupCache(bilibili *agent.Bilibili, flags map[string]string) {
+	if _, ok := flags["no-cache"]; ok {
+		if cacheEnabled(flags) {
+			fmt.Fprintf(os.Stderr, "--no-cache cannot be used with --cache or --cache-dir\n")
+			usageAndExit(1)
+		}
+		bilibili.DisableCache()
+		return
+	}
+	if limits := flags["cache-limits"]; limits != "" {
+		entries, bytes, err := parseCacheLimits(limits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usageAndExit(1)
+		}
+		bilibili.SetCacheLimits(entries, bytes)
+	}
+	if !cacheEnabled(flags) {
+		return
+	}
+	if err := bilibili.SetCacheDir(cacheDir(flags)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up the cache. Error is: %v\n", err)
+		os.Exit(110)
+	}
+}
+
+// parseCacheLimits parses --cache-limits, "<entries>,<size>" where the size
+// is in bytes or has a K, M or G suffix, 0 meaning unlimited.
+func parseCacheLimits(s string) (int, int64, error) {
+	invalid := fmt.Errorf("invalid cache limits %q, expect <entries>,<size> like 512,64M", s)
+	entries, size, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, invalid
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(entries))
+	if err != nil || n < 0 {
+		return 0, 0, invalid
+	}
+	size = strings.ToUpper(strings.TrimSpace(size))
+	unit := int64(1)
+	for suffix, u := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(size, suffix) {
+			size, unit = strings.TrimSuffix(size, suffix), u
+		}
+	}
+	bytes, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || bytes < 0 {
+		return 0, 0, invalid
+	}
+	return n, bytes * unit, nil
+}
+
+// cache runs the "cache clear" and "cache stats" commands.
+func cache(arguments []string, flags map[string]string) {
+	if len(arguments) != 1 {
+		usageAndExit(1)
+	}
+	dir := cacheDir(flags)
+	switch arguments[0] {
+	case "clear":
+		removed, err := utils.ClearDiskCache(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clear the cache. Error is: %v\n", err)
+			os.Exit(110)
+		}
+		fmt.Printf("Removed %d cached responses from %s\n", removed, dir)
+	case "stats":
+		stats, err := utils.GetDiskCacheStats(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache. Error is: %v\n", err)
+			os.Exit(110)
+		}
+		fmt.Printf("Directory:                  %s\n", dir)
+		fmt.Printf("Responses:                  %d\n", stats.Entries)
+		fmt.Printf("Size:                       %s\n", readableBytes(int(stats.Bytes)))
+		if stats.Entries > 0 {
+			fmt.Printf("Oldest:                     %s\n", stats.Oldest.Format("2006-01-02 15:04:05"))
+			fmt.Printf("Newest:                     %s\n", stats.Newest.Format("2006-01-02 15:04:05"))
+		}
+	default:
+		usageAndExit(1)
+	}
+}
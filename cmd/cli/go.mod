@@ -8,7 +8,7 @@ replace downloader => ../..
 
 require agent v1.0.0
 
-require internal/utils v1.0.0 // indirect
+require internal/utils v1.0.0
 
 replace agent => ../../agent
 
@@ -1,22 +1,46 @@
 package main
 
 import (
-	"agent"
 	"downloader"
+	"errors"
 	"fmt"
+	"internal/utils"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 func main() {
 	arguments, flags := parseArgs()
+	if len(arguments) == 0 {
+		usageAndExit(1)
+	}
+
+	// commands without url
+	switch arguments[0] {
+	case "login":
+		login(flags)
+		return
+	case "whoami":
+		url := ""
+		if len(arguments) > 1 {
+			url = arguments[1]
+		}
+		whoami(url, flags)
+		return
+	case "cache":
+		cache(arguments[1:], flags)
+		return
+	}
+
 	if len(arguments) != 2 {
 		usageAndExit(1)
 	}
 	command, url := arguments[0], arguments[1]
 
 	agents := []downloader.Downloader{
-		agent.NewBilibili(url, flags["sessdata"]),
+		newBilibili(url, flags),
 	}
 	var agent downloader.Downloader
 	for _, a := range agents {
@@ -30,30 +54,117 @@ func main() {
 		os.Exit(100)
 	}
 
+	if setter, ok := agent.(downloader.ParamsSetter); ok {
+		setter.SetParams(flags)
+	}
+
 	switch command {
 	case "info":
 		info, err := agent.GetResourceInfo()
+		if errors.Is(err, downloader.ErrCredentialInvalid) {
+			credentialInvalidAndExit(err)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error occured when getting resource information. Error is: %v\n", err)
 			os.Exit(101)
 		}
-		printInfo(info)
+		filter, err := downloader.NewStreamFilter(flags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usageAndExit(1)
+		}
+		printInfo(info, filter)
 	case "download":
-		progress := agent.Download(0, "")
-		for p := range progress {
-			if p.Err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to download. Error is: %v", p.Err)
-				os.Exit(102)
-			} else {
-				printProgress(p)
+		info, err := agent.GetResourceInfo()
+		if errors.Is(err, downloader.ErrCredentialInvalid) {
+			credentialInvalidAndExit(err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occured when getting resource information. Error is: %v\n", err)
+			os.Exit(101)
+		}
+		indexes := make([]int, 0, len(info))
+		if index, ok := flags["index"]; ok {
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 || i >= len(info) {
+				fmt.Fprintf(os.Stderr, "flag --index expects an integer between 0 and %d, got \"%s\"\n", len(info)-1, index)
+				usageAndExit(1)
+			}
+			indexes = append(indexes, i)
+		} else {
+			for i := range info {
+				indexes = append(indexes, i)
+			}
+		}
+
+		history := openHistory(flags)
+		_, skipDownloaded := flags["skip-downloaded"]
+		if _, ok := flags["index"]; !ok && !skipDownloaded {
+			// everything at once, which lets the agent handle the list as a
+			// whole, e.g. the choice graph of interactive videos
+			followProgress(agent.DownloadAll(flags["output"]))
+			fmt.Println("")
+			for i := range info {
+				if err := history.Add(info[i].Id); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to record download history. Error is: %v\n", err)
+				}
+			}
+			return
+		}
+		for n, i := range indexes {
+			if len(indexes) > 1 {
+				fmt.Printf("[%d/%d] %s\n", n+1, len(indexes), info[i].Name)
+			}
+			if skipDownloaded && history.Has(info[i].Id) {
+				fmt.Println("  Already downloaded, skipped.")
+				continue
+			}
+			followProgress(agent.Download(i, flags["output"]))
+			fmt.Println("")
+			if err := history.Add(info[i].Id); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to record download history. Error is: %v\n", err)
 			}
 		}
-		fmt.Println("")
 	default:
 		fmt.Fprintf(os.Stderr, "invalid command \"%s\"\n", command)
 	}
 }
 
+// followProgress prints the progress of a download until it is done, and
+// exits if it fails.
+func followProgress(progress chan *downloader.Progress) {
+	for p := range progress {
+		if errors.Is(p.Err, downloader.ErrCredentialInvalid) {
+			credentialInvalidAndExit(p.Err)
+		}
+		if p.Err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to download. Error is: %v", p.Err)
+			os.Exit(102)
+		} else {
+			printProgress(p)
+		}
+	}
+}
+
+// openHistory opens the download history given by --history, or the default one.
+func openHistory(flags map[string]string) *downloader.History {
+	path := flags["history"]
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot determine where to store download history, use --history. Error is: %v\n", err)
+			os.Exit(109)
+		}
+		path = filepath.Join(dir, "downloader", "history.txt")
+	}
+	history, err := downloader.OpenHistory(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open download history %s. Error is: %v\n", path, err)
+		os.Exit(109)
+	}
+	return history
+}
+
 func printProgress(p *downloader.Progress) {
 	var sb strings.Builder
 	sb.WriteString("  ")
@@ -106,6 +217,12 @@ func parseArgs() ([]string, map[string]string) {
 			if seenFlag {
 				flags[flagName] = "true"
 			}
+			if name, value, found := strings.Cut(arg[2:], "="); found {
+				// --flag=value
+				seenFlag = false
+				flags[name] = value
+				continue
+			}
 			seenFlag = true
 			flagName = arg[2:]
 		} else if strings.HasPrefix(arg, "-") {
@@ -131,34 +248,78 @@ func parseArgs() ([]string, map[string]string) {
 }
 
 func usageAndExit(exitCode int) {
-	fmt.Fprintf(os.Stderr, "usage: %s <command> <url> [flags]", os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s <command> <url> [--cookies=<cookies.txt or json>] [flags]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s login [--credential=<file>] [--proxy=<proxy>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s whoami [<sample video url>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s cache clear|stats [--cache-dir=<dir>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Responses are kept on disk across runs with --cache or --cache-dir=<dir>.\n")
+	fmt.Fprintf(os.Stderr, "Responses kept in memory are limited with --cache-limits=<entries>,<size>, %d,%dM by default, or not kept with --no-cache.\n", utils.DefaultCacheEntries, utils.DefaultCacheBytes>>20)
+	fmt.Fprintf(os.Stderr, "Requests failing with transient errors are sent up to --max-attempts=<n> times, %d by default.\n", utils.DefaultMaxAttempts)
+	fmt.Fprintf(os.Stderr, "Requests are limited per host with --rate-limit=[<host pattern>=]<requests per second>,...\n")
+	fmt.Fprintf(os.Stderr, "Proxies are set with --proxy=[<host pattern>=]<http, https or socks5 url, or direct>,...\n")
+	fmt.Fprintf(os.Stderr, "The user agent sent to the sites is set with --user-agent=<user agent>\n")
 	os.Exit(exitCode)
 }
 
-func printInfo(info []downloader.ResourceInfo) {
+func printInfo(info []downloader.ResourceInfo, filter *downloader.StreamFilter) {
 	if len(info) == 1 {
 		switch info[0].Type {
 		case downloader.RT_Video:
-			printVideoInfo(&info[0])
+			printVideoInfo(&info[0], filter)
 		default:
 
 		}
+	} else if len(info) > 1 {
+		printListInfo(info)
+	} else {
+		fmt.Println("No resources found.")
+	}
+}
+
+func printListInfo(info []downloader.ResourceInfo) {
+	fmt.Printf("Site:                       %s\n", info[0].Site)
+	if info[0].Metadata.Season != "" {
+		fmt.Printf("Season:                     %s\n", info[0].Metadata.Season)
+	}
+	fmt.Printf("Resources:                  %d in total, download one with argument --index=<index>\n", len(info))
+	for i, r := range info {
+		fmt.Printf("  [%3d] %s\n", i, r.Name)
 	}
 }
 
-func printVideoInfo(info *downloader.ResourceInfo) {
+func printVideoInfo(info *downloader.ResourceInfo, filter *downloader.StreamFilter) {
 	fmt.Printf("Site:                       %s\n", info.Site)
 	fmt.Printf("Title:                      %s\n", info.Name)
-	streamCnt := len(info.Streams)
-	if streamCnt == 0 {
-		fmt.Println("Streams:                    !! No streams available !! Attaching authentication information may help.")
+	if info.Id != "" {
+		fmt.Printf("Id:                         %s\n", info.Id)
+	}
+	printMetadata(&info.Metadata)
+	streams := filter.Filter(info.Streams)
+	if len(info.Streams) == 0 {
+		fmt.Println("Streams:                    !! No streams available !! Logging in with the \"login\" command may help.")
+	} else if len(streams) == 0 {
+		fmt.Println("Streams:                    !! No streams match the given filters !!")
 	} else {
 		fmt.Println("Streams:                    Available quality and codecs:")
-		if len(info.Streams) > 0 {
+		if len(streams) > 0 {
 			fmt.Println("  [ Video ] ___________________________________")
-			for _, s := range info.Streams {
+			for _, s := range streams {
 				fmt.Printf("  - format:                 %s\n", s.Id)
 				fmt.Printf("    container:              %s\n", s.Container)
+				if s.Codec != "" {
+					fmt.Printf("    codec:                  %s\n", s.Codec)
+				}
+				if s.Resolution[0] > 0 {
+					fmt.Printf("    resolution:             %dx%d\n", s.Resolution[0], s.Resolution[1])
+				} else if s.Resolution[1] > 0 {
+					fmt.Printf("    resolution:             %dp\n", s.Resolution[1])
+				}
+				if s.FrameRate > 0 {
+					fmt.Printf("    frame rate:             %g fps\n", s.FrameRate)
+				}
+				if s.Bandwidth > 0 {
+					fmt.Printf("    bandwidth:              %d kbps\n", s.Bandwidth/1000)
+				}
 				fmt.Printf("    size:                   %s\n", readableBytes(s.Size))
 				fmt.Printf("    download with argument: %s\n", s.DownloadWith)
 				for k, v := range s.Others {
@@ -167,6 +328,64 @@ func printVideoInfo(info *downloader.ResourceInfo) {
 				fmt.Println("")
 			}
 		}
+		if len(info.AudioStreams) > 0 {
+			fmt.Println("  [ Audio ] ___________________________________")
+			for _, s := range info.AudioStreams {
+				fmt.Printf("  - audio:                  %s\n", s.Id)
+				fmt.Printf("    codec:                  %s\n", s.Codec)
+				if s.Bandwidth > 0 {
+					fmt.Printf("    bandwidth:              %d kbps\n", s.Bandwidth/1000)
+				}
+				fmt.Printf("    size:                   %s\n", readableBytes(s.Size))
+				fmt.Printf("    download with argument: %s\n", s.DownloadWith)
+				for k, v := range s.Others {
+					fmt.Printf("    %s:%s%s\n", k, strings.Repeat(" ", 23-len(k)), v)
+				}
+				fmt.Println("")
+			}
+		}
+	}
+}
+
+func printMetadata(meta *downloader.Metadata) {
+	if meta.Uploader != "" {
+		if meta.UploaderId != "" {
+			fmt.Printf("Uploader:                   %s (uid %s)\n", meta.Uploader, meta.UploaderId)
+		} else {
+			fmt.Printf("Uploader:                   %s\n", meta.Uploader)
+		}
+	}
+	if !meta.PublishTime.IsZero() {
+		fmt.Printf("Published:                  %s\n", meta.PublishTime.Format("2006-01-02 15:04:05"))
+	}
+	if meta.Duration > 0 {
+		fmt.Printf("Duration:                   %s\n", meta.Duration)
+	}
+	if meta.Views > 0 {
+		fmt.Printf("Statistics:                 %d views, %d likes, %d coins, %d favorites\n",
+			meta.Views, meta.Likes, meta.Coins, meta.Favorites)
+		fmt.Printf("                            %d danmakus, %d comments, %d shares\n",
+			meta.Danmakus, meta.Comments, meta.Shares)
+	}
+	if meta.Season != "" {
+		if meta.Episode > 0 {
+			fmt.Printf("Season:                     %s (episode %d)\n", meta.Season, meta.Episode)
+		} else {
+			fmt.Printf("Season:                     %s, list every episode with argument --whole-season\n", meta.Season)
+		}
+	}
+	if len(meta.Tags) > 0 {
+		fmt.Printf("Tags:                       %s\n", strings.Join(meta.Tags, ", "))
+	}
+	if meta.Cover != "" {
+		fmt.Printf("Cover:                      %s\n", meta.Cover)
+	}
+	if meta.Description != "" {
+		lines := strings.Split(strings.TrimSpace(meta.Description), "\n")
+		fmt.Printf("Description:                %s\n", lines[0])
+		for _, line := range lines[1:] {
+			fmt.Printf("                            %s\n", line)
+		}
 	}
 }
 
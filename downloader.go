@@ -1,5 +1,10 @@
 package downloader
 
+import (
+	"net/http"
+	"time"
+)
+
 /*
  TODO features
  1. connect to DB and save download status
@@ -20,6 +25,8 @@ const (
 )
 
 type ResourceInfo struct {
+	// Id is the canonical id of the resource, see CanonicalId.
+	Id           string
 	Site         string
 	Name         string
 	Size         int
@@ -27,18 +34,55 @@ type ResourceInfo struct {
 	Type         ResourceType
 	DownloadWith string
 	Others       map[string]string
+	Metadata     Metadata
 	Streams      []StreamInfo
+	AudioStreams []StreamInfo
+}
+
+// Metadata describes the resource itself rather than how to download it.
+// Agents fill in whatever the site exposes; missing fields keep their zero value.
+type Metadata struct {
+	Uploader    string
+	UploaderId  string
+	PublishTime time.Time
+	Duration    time.Duration
+	Description string
+	Tags        []string
+	Cover       string
+	Season      string // the season, series or playlist the resource belongs to
+	SeasonId    string
+	Episode     int
+	Views       int
+	Likes       int
+	Coins       int
+	Favorites   int
+	Danmakus    int
+	Comments    int
+	Shares      int
 }
 
 type StreamInfo struct {
 	Id           string
 	Codec        string
-	Resolution   [2]int
+	Resolution   [2]int // width, height
 	Container    string
+	Bandwidth    int // bits per second
+	FrameRate    float64
 	Size         int
 	DownloadWith string
 	Url          []string
-	Others       map[string]string
+	// BackupUrl holds the mirrors of each entry of Url, if there are any.
+	BackupUrl [][]string
+	Others    map[string]string
+}
+
+// Mirrors returns Url[i] followed by its backup urls.
+func (s *StreamInfo) Mirrors(i int) []string {
+	mirrors := []string{s.Url[i]}
+	if i < len(s.BackupUrl) {
+		mirrors = append(mirrors, s.BackupUrl[i]...)
+	}
+	return mirrors
 }
 
 type Progress struct {
@@ -47,11 +91,35 @@ type Progress struct {
 	Err        error
 }
 
+// AgentOptions customizes how an agent talks to its site. The zero value
+// gives the defaults of the agent.
+type AgentOptions struct {
+	// Client sends the requests, keeping its timeout, redirect policy and
+	// transport. Its cookie jar is replaced by the one of the agent. The
+	// timeout applies to API and page requests only, downloads of streams
+	// are aborted when they stall instead.
+	Client *http.Client
+	// Transport, if set, replaces the transport of Client.
+	Transport http.RoundTripper
+	// UserAgent replaces the default user agent of the agent.
+	UserAgent string
+	// Header is added to every request, overriding the headers the agent
+	// sets itself. An empty value removes the header.
+	Header map[string]string
+}
+
 // TODO better comment
 // 1. downloaders are one-off
 type Downloader interface {
 	CanHandle(url string) bool
 	GetResourceInfo() ([]ResourceInfo, error)
 	Download(index int, path string) chan *Progress
-	DownloadAll(path string) (chan byte, error)
+	DownloadAll(path string) chan *Progress
+}
+
+// ParamsSetter is implemented by downloaders taking parameters, e.g. the
+// stream to download or filters on the streams. Parameters are set before
+// GetResourceInfo.
+type ParamsSetter interface {
+	SetParams(params Params)
 }
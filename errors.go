@@ -3,3 +3,4 @@ package downloader
 import "errors"
 
 var ErrUnimplemented = errors.New("not implemented.")
+var ErrCredentialInvalid = errors.New("credential is invalid or expired.")
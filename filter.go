@@ -0,0 +1,86 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StreamFilter selects streams by their technical properties.
+// Zero-valued fields match every stream.
+type StreamFilter struct {
+	Codec        string
+	MinHeight    int
+	MaxHeight    int
+	MaxBandwidth int
+	MinFrameRate float64
+	MaxFrameRate float64
+}
+
+func (f *StreamFilter) Match(s *StreamInfo) bool {
+	if f.Codec != "" && !strings.EqualFold(f.Codec, s.Codec) {
+		return false
+	}
+	height := s.Resolution[1]
+	if f.MinHeight > 0 && height < f.MinHeight {
+		return false
+	}
+	if f.MaxHeight > 0 && height > f.MaxHeight {
+		return false
+	}
+	if f.MaxBandwidth > 0 && s.Bandwidth > f.MaxBandwidth {
+		return false
+	}
+	if f.MinFrameRate > 0 && s.FrameRate < f.MinFrameRate {
+		return false
+	}
+	if f.MaxFrameRate > 0 && s.FrameRate > f.MaxFrameRate {
+		return false
+	}
+	return true
+}
+
+// Filter returns the streams matching f, keeping their order.
+func (f *StreamFilter) Filter(streams []StreamInfo) []StreamInfo {
+	ret := make([]StreamInfo, 0, len(streams))
+	for i := range streams {
+		if f.Match(&streams[i]) {
+			ret = append(ret, streams[i])
+		}
+	}
+	return ret
+}
+
+// NewStreamFilter builds a stream filter from the "codec", "min-height",
+// "max-height", "max-bandwidth", "min-fps" and "max-fps" parameters.
+func NewStreamFilter(params Params) (*StreamFilter, error) {
+	filter := &StreamFilter{Codec: params["codec"]}
+	ints := map[string]*int{
+		"min-height":    &filter.MinHeight,
+		"max-height":    &filter.MaxHeight,
+		"max-bandwidth": &filter.MaxBandwidth,
+	}
+	for name, field := range ints {
+		if v, ok := params[name]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s expects an integer, got \"%s\"", name, v)
+			}
+			*field = n
+		}
+	}
+	floats := map[string]*float64{
+		"min-fps": &filter.MinFrameRate,
+		"max-fps": &filter.MaxFrameRate,
+	}
+	for name, field := range floats {
+		if v, ok := params[name]; ok {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s expects a number, got \"%s\"", name, v)
+			}
+			*field = n
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CanonicalId identifies a resource regardless of the url it was reached by,
+// e.g. "bilibili:video:BV17x411w7KC:p1". part is optional.
+func CanonicalId(site string, kind string, id string, part string) string {
+	canonical := strings.ToLower(site) + ":" + kind + ":" + id
+	if part != "" {
+		canonical += ":" + part
+	}
+	return canonical
+}
+
+// Dedup removes resources whose canonical id appeared earlier in infos.
+// Resources without canonical id are kept.
+func Dedup(infos []ResourceInfo) []ResourceInfo {
+	seen := make(map[string]bool)
+	ret := make([]ResourceInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Id != "" {
+			if seen[info.Id] {
+				continue
+			}
+			seen[info.Id] = true
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// History remembers the canonical ids of downloaded resources in a file,
+// one id per line.
+type History struct {
+	path string
+	ids  map[string]bool
+}
+
+// OpenHistory loads the history saved in path. A missing file is an empty
+// history.
+func OpenHistory(path string) (*History, error) {
+	h := &History{path: path, ids: make(map[string]bool)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			h.ids[id] = true
+		}
+	}
+	return h, scanner.Err()
+}
+
+func (h *History) Has(id string) bool {
+	return h.ids[id]
+}
+
+// Add records id and appends it to the history file.
+func (h *History) Add(id string) error {
+	if id == "" || h.ids[id] {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, id); err != nil {
+		return err
+	}
+	h.ids[id] = true
+	return nil
+}
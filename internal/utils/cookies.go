@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieJar is an http.CookieJar that can also be filled from cookie files
+// and enumerated, so the cookies can be saved again.
+//
+// Cookies whose Domain starts with a dot apply to subdomains as well, like
+// in cookies.txt files; other cookies only apply to their exact host.
+type CookieJar struct {
+	mu      sync.Mutex
+	entries map[string]*http.Cookie
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{entries: make(map[string]*http.Cookie)}
+}
+
+func jarKey(c *http.Cookie) string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// Add stores cookies which already carry their domain, e.g. imported ones.
+// A cookie without expiry or with an expiry in the future replaces the
+// stored one with the same domain, path and name; an expired one removes it.
+func (j *CookieJar) Add(cookies ...*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		c := *c
+		c.Domain = strings.ToLower(c.Domain)
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if c.MaxAge > 0 {
+			c.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		}
+		key := jarKey(&c)
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(j.entries, key)
+			continue
+		}
+		j.entries[key] = &c
+	}
+}
+
+// SetCookies implements http.CookieJar, storing cookies received from u.
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	accepted := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		c := *c
+		if c.Domain == "" {
+			c.Domain = host
+		} else {
+			domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+			switch {
+			case host == domain && (isPublicSuffix(domain) || net.ParseIP(host) != nil):
+				// a cookie for a whole suffix or ip, only its host gets it
+				c.Domain = host
+			case host == domain:
+				c.Domain = "." + domain
+			case !strings.HasSuffix(host, "."+domain), isPublicSuffix(domain), net.ParseIP(host) != nil:
+				// a host can only set cookies for itself and its parents
+				// which are registrable domains, not e.g. "com" or "com.cn"
+				continue
+			default:
+				c.Domain = "." + domain
+			}
+		}
+		if c.Path == "" || !strings.HasPrefix(c.Path, "/") {
+			c.Path = defaultCookiePath(u.Path)
+		}
+		accepted = append(accepted, &c)
+	}
+	j.Add(accepted...)
+}
+
+// publicSuffixes are the suffixes under which domains are registered, for
+// the sites the agents deal with. Top-level domains are public suffixes as
+// well, see isPublicSuffix.
+var publicSuffixes = map[string]bool{
+	"com.cn": true, "net.cn": true, "org.cn": true, "gov.cn": true, "edu.cn": true, "ac.cn": true,
+	"com.hk": true, "net.hk": true, "org.hk": true, "com.tw": true, "net.tw": true, "org.tw": true,
+	"com.mo": true, "com.sg": true, "com.au": true, "net.au": true, "org.au": true, "com.br": true,
+	"co.jp": true, "ne.jp": true, "or.jp": true, "ac.jp": true, "co.kr": true, "or.kr": true,
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "co.in": true, "co.nz": true,
+	"github.io": true, "gitlab.io": true, "appspot.com": true, "herokuapp.com": true,
+}
+
+// isPublicSuffix tells whether cookies must not be set for every host under
+// domain: domains of a single label like "com" or "localhost", and the known
+// public suffixes like "com.cn". It is not the complete Public Suffix List,
+// which is not available offline.
+func isPublicSuffix(domain string) bool {
+	return !strings.Contains(domain, ".") || publicSuffixes[domain]
+}
+
+// Cookies implements http.CookieJar, returning the cookies to send to u.
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	matched := make([]*http.Cookie, 0)
+	for key, c := range j.entries {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if strings.HasPrefix(c.Domain, ".") {
+			domain := c.Domain[1:]
+			if host != domain && !strings.HasSuffix(host, c.Domain) {
+				continue
+			}
+		} else if host != c.Domain {
+			continue
+		}
+		if !pathMatches(path, c.Path) {
+			continue
+		}
+		if c.Secure && u.Scheme != "https" && u.Scheme != "wss" {
+			continue
+		}
+		matched = append(matched, &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path})
+	}
+	// longer paths first, as required by RFC 6265
+	slices.SortStableFunc(matched, func(a, b *http.Cookie) int {
+		return len(b.Path) - len(a.Path)
+	})
+	return matched
+}
+
+// All returns a copy of every stored cookie.
+func (j *CookieJar) All() []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	all := make([]*http.Cookie, 0, len(j.entries))
+	for _, c := range j.entries {
+		c := *c
+		all = append(all, &c)
+	}
+	slices.SortFunc(all, func(a, b *http.Cookie) int {
+		return strings.Compare(jarKey(a), jarKey(b))
+	})
+	return all
+}
+
+// Value returns the value of the cookie named name that would be sent to
+// rawUrl, or "" if there is none.
+func (j *CookieJar) Value(rawUrl string, name string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	for _, c := range j.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func defaultCookiePath(urlPath string) string {
+	i := strings.LastIndex(urlPath, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return urlPath[:i]
+}
+
+func pathMatches(requestPath string, cookiePath string) bool {
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
+
+// LoadCookieFile reads cookies from a Netscape cookies.txt file or from a
+// JSON file exported by browser extensions, telling them apart by content.
+func LoadCookieFile(path string) ([]*http.Cookie, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return ParseJsonCookies(trimmed)
+	}
+	return ParseNetscapeCookies(content)
+}
+
+// ParseNetscapeCookies parses the cookies.txt format used by curl, wget and
+// youtube-dl: one cookie per line with the tab separated fields domain,
+// include subdomains, path, secure, expiry, name and value.
+func ParseNetscapeCookies(content []byte) ([]*http.Cookie, error) {
+	cookies := make([]*http.Cookie, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			httpOnly = true
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// empty value
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expect 7 tab separated fields, got %d", lineNo, len(fields))
+		}
+
+		c := &http.Cookie{
+			Domain:   strings.ToLower(fields[0]),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		includeSubdomains := strings.EqualFold(fields[1], "TRUE")
+		domain := strings.TrimPrefix(c.Domain, ".")
+		if includeSubdomains {
+			c.Domain = "." + domain
+		} else {
+			c.Domain = domain
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: expiry is not an integer", lineNo)
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// jsonCookie is the format of browser extensions like EditThisCookie and
+// Cookie-Editor.
+type jsonCookie struct {
+	Domain         string  `json:"domain"`
+	HostOnly       bool    `json:"hostOnly"`
+	Path           string  `json:"path"`
+	Secure         bool    `json:"secure"`
+	HttpOnly       bool    `json:"httpOnly"`
+	Session        bool    `json:"session"`
+	ExpirationDate float64 `json:"expirationDate"`
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+}
+
+// ParseJsonCookies parses cookies exported by browser extensions, either a
+// JSON array of cookies or an object with a "cookies" array.
+func ParseJsonCookies(content []byte) ([]*http.Cookie, error) {
+	var list []jsonCookie
+	if err := json.Unmarshal(content, &list); err != nil {
+		var wrapped struct {
+			Cookies []jsonCookie `json:"cookies"`
+		}
+		if err2 := json.Unmarshal(content, &wrapped); err2 != nil {
+			return nil, fmt.Errorf("invalid json cookie file: %v", err)
+		}
+		list = wrapped.Cookies
+	}
+
+	cookies := make([]*http.Cookie, 0, len(list))
+	for _, jc := range list {
+		domain := strings.TrimPrefix(strings.ToLower(jc.Domain), ".")
+		if !jc.HostOnly {
+			domain = "." + domain
+		}
+		c := &http.Cookie{
+			Domain:   domain,
+			Path:     jc.Path,
+			Secure:   jc.Secure,
+			HttpOnly: jc.HttpOnly,
+			Name:     jc.Name,
+			Value:    jc.Value,
+		}
+		if !jc.Session && jc.ExpirationDate > 0 {
+			c.Expires = time.Unix(int64(jc.ExpirationDate), 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, nil
+}
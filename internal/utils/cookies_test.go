@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCookieJar(t *testing.T) {
+	content := "# Netscape HTTP Cookie File\n" +
+		".bilibili.com\tTRUE\t/\tFALSE\t0\tSESSDATA\tsess\n" +
+		"#HttpOnly_www.bilibili.com\tFALSE\t/\tTRUE\t4102444800\tbuvid3\tbuvid\n" +
+		".bilibili.com\tTRUE\t/\tFALSE\t1\texpired\tvalue\n"
+	cookies, err := ParseNetscapeCookies([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseNetscapeCookies() returned error: %v", err)
+	}
+	if len(cookies) != 3 {
+		t.Fatalf("expect 3 cookies, got %d", len(cookies))
+	}
+	if !cookies[1].HttpOnly || !cookies[1].Secure {
+		t.Errorf("expect buvid3 to be http only and secure")
+	}
+
+	jar := NewCookieJar()
+	jar.Add(cookies...)
+	if v := jar.Value("https://api.bilibili.com/x/player", "SESSDATA"); v != "sess" {
+		t.Errorf("expect SESSDATA on subdomain, got %q", v)
+	}
+	if v := jar.Value("https://api.bilibili.com/", "buvid3"); v != "" {
+		t.Errorf("expect host only cookie not to be sent to other hosts, got %q", v)
+	}
+	if v := jar.Value("http://www.bilibili.com/", "buvid3"); v != "" {
+		t.Errorf("expect secure cookie not to be sent over http, got %q", v)
+	}
+	if v := jar.Value("https://www.bilibili.com/", "buvid3"); v != "buvid" {
+		t.Errorf("expect buvid3 on its host, got %q", v)
+	}
+	if v := jar.Value("https://www.bilibili.com/", "expired"); v != "" {
+		t.Errorf("expect expired cookie to be dropped, got %q", v)
+	}
+
+	u, _ := url.Parse("https://passport.bilibili.com/x/passport-login/web/qrcode/poll")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "SESSDATA", Value: "new", Domain: "bilibili.com", Path: "/"},
+		{Name: "evil", Value: "x", Domain: "example.com"},
+	})
+	if v := jar.Value("https://www.bilibili.com/video/", "SESSDATA"); v != "new" {
+		t.Errorf("expect SESSDATA to be updated by Set-Cookie, got %q", v)
+	}
+	if v := jar.Value("https://example.com/", "evil"); v != "" {
+		t.Errorf("expect cookies for foreign domains to be rejected, got %q", v)
+	}
+
+	// cookies for a whole top-level domain or public suffix
+	for _, tc := range []struct{ from, domain, victim string }{
+		{"https://www.bilibili.com/", "com", "https://example.com/"},
+		{"https://www.bilibili.com/", ".com", "https://example.com/"},
+		{"https://www.example.com.cn/", "com.cn", "https://other.com.cn/"},
+		{"https://user.github.io/", "github.io", "https://other.github.io/"},
+		{"http://127.0.0.1/", "0.0.1", "http://10.0.0.1/"},
+	} {
+		u, _ := url.Parse(tc.from)
+		jar.SetCookies(u, []*http.Cookie{{Name: "suffix", Value: "x", Domain: tc.domain}})
+		if v := jar.Value(tc.victim, "suffix"); v != "" {
+			t.Errorf("expect a cookie for %s set by %s to be rejected, got %q on %s", tc.domain, tc.from, v, tc.victim)
+		}
+	}
+	// a host named like a suffix keeps its cookies to itself
+	u, _ = url.Parse("http://localhost:8080/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "local", Value: "x", Domain: "localhost"}})
+	if v := jar.Value("http://localhost/", "local"); v != "x" {
+		t.Errorf("expect the cookie on its host, got %q", v)
+	}
+	if v := jar.Value("http://sub.localhost/", "local"); v != "" {
+		t.Errorf("expect the cookie not to be sent to subdomains, got %q", v)
+	}
+}
+
+func TestParseJsonCookies(t *testing.T) {
+	content := `[{"domain":".bilibili.com","hostOnly":false,"path":"/","name":"SESSDATA","value":"sess","expirationDate":4102444800.5},
+		{"domain":"www.bilibili.com","hostOnly":true,"path":"/","name":"host","value":"only","session":true}]`
+	cookies, err := ParseJsonCookies([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseJsonCookies() returned error: %v", err)
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("expect 2 cookies, got %d", len(cookies))
+	}
+	if cookies[0].Domain != ".bilibili.com" || cookies[0].Expires.Unix() != 4102444800 {
+		t.Errorf("unexpected first cookie %v", cookies[0])
+	}
+	if cookies[1].Domain != "www.bilibili.com" || !cookies[1].Expires.IsZero() {
+		t.Errorf("unexpected second cookie %v", cookies[1])
+	}
+}
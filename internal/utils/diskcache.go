@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCache persists responses across runs, one file per response named
+// after the hash of its cache key. The key may contain cookies, so it is
+// not stored itself.
+type diskCache struct {
+	dir string
+	// ttl tells how long a response of an url stays fresh, 0 for not caching
+	// it on disk
+	ttl func(u *url.URL) time.Duration
+}
+
+const diskCacheExt = ".cache"
+
+// diskCacheEntry is stored as a line of json followed by the body.
+type diskCacheEntry struct {
+	Url          string    `json:"url"`
+	StoredAt     time.Time `json:"stored_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	body         []byte
+}
+
+func newDiskCache(dir string, ttl func(u *url.URL) time.Duration) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %v", dir, err)
+	}
+	return &diskCache{dir: dir, ttl: ttl}, nil
+}
+
+func (d *diskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(hash[:])+diskCacheExt)
+}
+
+func (d *diskCache) load(key string) (*diskCacheEntry, error) {
+	content, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+	header, body, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("cache entry is truncated")
+	}
+	var entry diskCacheEntry
+	if err := json.Unmarshal(header, &entry); err != nil {
+		return nil, fmt.Errorf("invalid cache entry: %v", err)
+	}
+	entry.body = body
+	return &entry, nil
+}
+
+// store writes the entry to a temporary file first, so concurrent runs never
+// read a partial entry.
+func (d *diskCache) store(key string, entry *diskCacheEntry) error {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(d.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.Write(header)
+	w.WriteByte('\n')
+	w.Write(entry.body)
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), d.path(key))
+}
+
+// DiskCacheStats describes the content of a cache directory.
+type DiskCacheStats struct {
+	Entries int
+	Bytes   int64
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+func diskCacheFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskCacheExt))
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetDiskCacheStats counts the responses cached in dir.
+func GetDiskCacheStats(dir string) (DiskCacheStats, error) {
+	var stats DiskCacheStats
+	files, err := diskCacheFiles(dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		stats.Entries++
+		stats.Bytes += info.Size()
+		if stats.Oldest.IsZero() || info.ModTime().Before(stats.Oldest) {
+			stats.Oldest = info.ModTime()
+		}
+		if info.ModTime().After(stats.Newest) {
+			stats.Newest = info.ModTime()
+		}
+	}
+	return stats, nil
+}
+
+// ClearDiskCache removes the responses cached in dir, leaving other files
+// alone. It returns how many were removed.
+func ClearDiskCache(dir string) (int, error) {
+	files, err := diskCacheFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	// left behind by interrupted runs
+	if temps, err := filepath.Glob(filepath.Join(dir, "tmp-*")); err == nil {
+		for _, f := range temps {
+			os.Remove(f)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	requests, revalidations := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	get := func(ttl time.Duration) string {
+		c := NewCachedHttpClient()
+		if err := c.SetDiskCache(dir, func(*url.URL) time.Duration { return ttl }); err != nil {
+			t.Fatalf("SetDiskCache() returned error: %v", err)
+		}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		content, err := c.GetBody(req)
+		if err != nil {
+			t.Fatalf("GetBody() returned error: %v", err)
+		}
+		return string(content)
+	}
+
+	// every client is a new run
+	if get(time.Hour) != "content" || get(time.Hour) != "content" {
+		t.Fatalf("expect the content")
+	}
+	if requests != 1 {
+		t.Errorf("expect the second run to use the disk, got %d requests", requests)
+	}
+	if get(time.Nanosecond) != "content" || revalidations != 1 {
+		t.Errorf("expect stale content to be revalidated, got %d revalidations", revalidations)
+	}
+
+	stats, err := GetDiskCacheStats(dir)
+	if err != nil || stats.Entries != 1 {
+		t.Errorf("expect 1 entry, got %+v, error %v", stats, err)
+	}
+	if removed, err := ClearDiskCache(dir); err != nil || removed != 1 {
+		t.Errorf("expect 1 entry removed, got %d, error %v", removed, err)
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A download receiving less than downloadStallBytes within
+// downloadStallWindow, response headers included, is aborted as stalled.
+var (
+	downloadStallWindow = 30 * time.Second
+	downloadStallBytes  = int64(64 * 1024)
+)
+
+var ErrDownloadStalled = errors.New("download stalled")
+
+// DownloadFile saves the body of the GET request req to path. The content is
+// written to "<path>.part" first and renamed when complete, so an interrupted
+// download resumes from where it stopped with a Range request.
+// onProgress, if not nil, is called with the total number of bytes on disk.
+// The download fails with ErrDownloadStalled if the throughput drops too low.
+func DownloadFile(client *http.Client, req *http.Request, path string, onProgress func(written int64)) error {
+	partPath := path + ".part"
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %v", partPath, err)
+	}
+	defer file.Close()
+
+	written, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek file %s: %v", partPath, err)
+	}
+	if written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	received := atomic.Int64{}
+	stalled := atomic.Bool{}
+	// read once, the watchdog may outlive the call
+	window, minBytes := downloadStallWindow, downloadStallBytes
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if received.Swap(0) < minBytes {
+					stalled.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	stallError := func(err error) error {
+		if stalled.Load() {
+			return fmt.Errorf("%w: less than %d bytes received in %s", ErrDownloadStalled, minBytes, window)
+		}
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return stallError(fmt.Errorf("GET request got error: %v", err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server ignored the range, start over
+		if written > 0 {
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("failed to truncate file %s: %v", partPath, err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek file %s: %v", partPath, err)
+			}
+			written = 0
+		}
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is already complete
+		if written == 0 || !strings.HasSuffix(resp.Header.Get("Content-Range"), fmt.Sprintf("/%d", written)) {
+			return fmt.Errorf("http status code is %d", resp.StatusCode)
+		}
+		file.Close()
+		return os.Rename(partPath, path)
+	default:
+		return fmt.Errorf("http status code is %d", resp.StatusCode)
+	}
+
+	if onProgress != nil {
+		onProgress(written)
+	}
+	buf := make([]byte, 256*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to write file %s: %v", partPath, err)
+			}
+			written += int64(n)
+			received.Add(int64(n))
+			if onProgress != nil {
+				onProgress(written)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stallError(fmt.Errorf("failed to read response body: %v", err))
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %v", partPath, err)
+	}
+	return os.Rename(partPath, path)
+}
+
+// DownloadFileMirrors downloads like DownloadFile, trying the requests in
+// order: when the download from one mirror fails, stalls included, the next
+// mirror continues from the bytes already on disk.
+func DownloadFileMirrors(client *http.Client, reqs []*http.Request, path string, onProgress func(written int64)) error {
+	errs := make([]error, 0, len(reqs))
+	for _, req := range reqs {
+		err := DownloadFile(client, req, path, onProgress)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", req.URL.Host, err))
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("all %d mirrors failed: %w", len(errs), errors.Join(errs...))
+}
+
+// SanitizeFilename replaces characters that are not allowed in file names on
+// common file systems.
+func SanitizeFilename(name string) string {
+	replacer := strings.NewReplacer(
+		"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+		"\"", "_", "<", "_", ">", "_", "|", "_", "\n", " ", "\r", " ")
+	name = strings.TrimSpace(replacer.Replace(name))
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileMirrors(t *testing.T) {
+	window, stallBytes := downloadStallWindow, downloadStallBytes
+	downloadStallWindow, downloadStallBytes = 200*time.Millisecond, 1<<20
+	defer func() { downloadStallWindow, downloadStallBytes = window, stallBytes }()
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	// sends the first 4000 bytes, then stalls
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:4000])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer stalling.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	var gotRange string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer healthy.Close()
+
+	reqs := make([]*http.Request, 0)
+	for _, u := range []string{stalling.URL, forbidden.URL, healthy.URL} {
+		req, _ := http.NewRequest("GET", u, nil)
+		reqs = append(reqs, req)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := DownloadFileMirrors(http.DefaultClient, reqs, path, nil); err != nil {
+		t.Fatalf("DownloadFileMirrors() returned error: %v", err)
+	}
+	if gotRange != "bytes=4000-" {
+		t.Errorf("expect the last mirror to resume from byte 4000, got range %q", gotRange)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, content) {
+		t.Errorf("expect the complete content, got %d bytes", len(got))
+	}
+
+	// every mirror failing
+	req, _ := http.NewRequest("GET", stalling.URL, nil)
+	err := DownloadFileMirrors(http.DefaultClient, []*http.Request{req}, filepath.Join(t.TempDir(), "file"), nil)
+	if !errors.Is(err, ErrDownloadStalled) || !strings.Contains(err.Error(), "127.0.0.1") {
+		t.Errorf("expect stall error naming the mirror, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FfmpegAvailable reports whether ffmpeg can be found in PATH.
+func FfmpegAvailable() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// MergeTracks muxes separate tracks, e.g. a video and an audio track, into
+// output without re-encoding.
+func MergeTracks(output string, inputs ...string) error {
+	args := []string{"-y", "-loglevel", "error"}
+	for _, input := range inputs {
+		args = append(args, "-i", input)
+	}
+	for i := range inputs {
+		args = append(args, "-map", fmt.Sprintf("%d", i))
+	}
+	args = append(args, "-c", "copy", output)
+	return runFfmpeg(args)
+}
+
+// ConcatSegments joins consecutive segments of the same format into output
+// without re-encoding.
+func ConcatSegments(output string, segments []string) error {
+	list, err := os.CreateTemp("", "concat-*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create concat list: %v", err)
+	}
+	defer os.Remove(list.Name())
+	for _, segment := range segments {
+		// paths in the list are relative to the list itself
+		if abs, err := filepath.Abs(segment); err == nil {
+			segment = abs
+		}
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(segment, "'", `'\''`))
+	}
+	list.Close()
+
+	return runFfmpeg([]string{"-y", "-loglevel", "error", "-f", "concat", "-safe", "0", "-i", list.Name(), "-c", "copy", output})
+}
+
+func runFfmpeg(args []string) error {
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
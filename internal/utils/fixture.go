@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Fixture holds http interactions, recorded from the real sites by the
+// transport of Recorder and served by the transport of Replayer, so tests
+// can run offline and give the same results until recorded again.
+//
+// Requests are matched by method and url, ignoring the query parameters
+// that change on every request like the WBI signature. A request sent
+// several times gets the recorded responses in order, then the last one
+// again.
+type Fixture struct {
+	Interactions []*Interaction `json:"interactions"`
+
+	mu     sync.Mutex
+	served map[string]int
+}
+
+type Interaction struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// the body is kept as text when it is, base64 encoded otherwise
+	Body       string `json:"body,omitempty"`
+	BodyBase64 string `json:"body_base64,omitempty"`
+}
+
+// query parameters which differ between the recording and the replay
+var volatileParams = []string{"wts", "w_rid"}
+
+// response headers not kept in fixtures, as they may carry credentials
+var unrecordedHeaders = []string{"Set-Cookie"}
+
+// LoadFixture reads a fixture saved by Fixture.Save.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &Fixture{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Save writes the interactions to path, creating its directory if needed.
+func (f *Fixture) Save(path string) error {
+	f.mu.Lock()
+	data, err := json.MarshalIndent(f, "", "  ")
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func fixtureKey(method string, rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return method + " " + rawUrl
+	}
+	query := u.Query()
+	for _, p := range volatileParams {
+		query.Del(p)
+	}
+	u.RawQuery = query.Encode()
+	return method + " " + u.String()
+}
+
+// Recorder returns a transport sending requests with base and adding them to
+// the fixture with their responses. An interaction is added once its
+// response body is closed, with the part of the body read until then, so
+// responses only looked at for their headers are not downloaded.
+func (f *Fixture) Recorder(base http.RoundTripper) http.RoundTripper {
+	return recordingTransport{fixture: f, base: base}
+}
+
+type recordingTransport struct {
+	fixture *Fixture
+	base    http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	header := resp.Header.Clone()
+	for _, h := range unrecordedHeaders {
+		header.Del(h)
+	}
+	interaction := &Interaction{
+		Method: req.Method,
+		Url:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: header,
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, fixture: t.fixture, interaction: interaction}
+	return resp, nil
+}
+
+type recordingBody struct {
+	io.ReadCloser
+	fixture     *Fixture
+	interaction *Interaction
+	body        strings.Builder
+	closed      bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.body.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		if body := b.body.String(); utf8.ValidString(body) {
+			b.interaction.Body = body
+		} else {
+			b.interaction.BodyBase64 = base64.StdEncoding.EncodeToString([]byte(body))
+		}
+		b.fixture.mu.Lock()
+		b.fixture.Interactions = append(b.fixture.Interactions, b.interaction)
+		b.fixture.mu.Unlock()
+	}
+	return b.ReadCloser.Close()
+}
+
+// Replayer returns a transport answering requests with the recorded
+// responses, and failing for requests which were not recorded.
+func (f *Fixture) Replayer() http.RoundTripper {
+	return replayingTransport{fixture: f}
+}
+
+type replayingTransport struct {
+	fixture *Fixture
+}
+
+func (t replayingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	interaction := t.fixture.next(fixtureKey(req.Method, req.URL.String()))
+	if interaction == nil {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	}
+
+	body := []byte(interaction.Body)
+	if interaction.BodyBase64 != "" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(interaction.BodyBase64); err != nil {
+			return nil, fmt.Errorf("invalid recorded body of %s: %v", interaction.Url, err)
+		}
+	}
+	header := interaction.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	contentLength := int64(len(body))
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		// the body may have been recorded partially
+		contentLength = length
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
+
+// next returns the response to serve for key, or nil if there is none.
+func (f *Fixture) next(key string) *Interaction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.served == nil {
+		f.served = make(map[string]int)
+	}
+	var matched []*Interaction
+	for _, interaction := range f.Interactions {
+		if fixtureKey(interaction.Method, interaction.Url) == key {
+			matched = append(matched, interaction)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	i := min(f.served[key], len(matched)-1)
+	f.served[key]++
+	return matched[i]
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFixtureRecordAndReplay(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Set-Cookie", "SESSDATA=secret")
+		switch r.URL.Path {
+		case "/api":
+			fmt.Fprintf(w, `{"call":%d}`, calls)
+		case "/stream":
+			w.Header().Set("Content-Length", strconv.Itoa(1<<16))
+			w.Write([]byte(strings.Repeat("x", 1<<16)))
+		}
+	}))
+	defer server.Close()
+
+	fixture := &Fixture{}
+	client := &http.Client{Transport: fixture.Recorder(http.DefaultTransport)}
+	get := func(client *http.Client, rawUrl string, read bool) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("GET %s returned error: %v", rawUrl, err)
+		}
+		defer resp.Body.Close()
+		if !read {
+			return resp, ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	get(client, server.URL+"/api?a=1&wts=100&w_rid=abc", true)
+	get(client, server.URL+"/api?a=1&wts=200&w_rid=def", true)
+	get(client, server.URL+"/stream", false)
+
+	path := filepath.Join(t.TempDir(), "testdata", "fixture.json")
+	if err := fixture.Save(path); err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	loaded, err := LoadFixture(path)
+	if err != nil {
+		t.Fatalf("LoadFixture() returned error: %v", err)
+	}
+	server.Close()
+
+	client = &http.Client{Transport: loaded.Replayer()}
+	// the signature differs from the recording, and responses come in order
+	for i, expected := range []string{`{"call":1}`, `{"call":2}`, `{"call":2}`} {
+		resp, body := get(client, server.URL+"/api?w_rid=xyz&a=1&wts=300", true)
+		if body != expected {
+			t.Errorf("expect response %d to be %s, got %s", i, expected, body)
+		}
+		if resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("expect Set-Cookie not to be recorded")
+		}
+	}
+	if resp, _ := get(client, server.URL+"/stream", false); resp.ContentLength != 1<<16 {
+		t.Errorf("expect the recorded content length, got %d", resp.ContentLength)
+	}
+	if _, err := client.Get(server.URL + "/api?a=2"); err == nil {
+		t.Errorf("expect error for a request not recorded")
+	}
+}
@@ -1,24 +1,205 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// default limits of the response cache
+const (
+	DefaultCacheEntries = 512
+	DefaultCacheBytes   = 64 << 20
+)
+
+// CachedHttpClient is safe for concurrent use. Identical requests sent at the
+// same time by GetBody share a single fetch.
 type CachedHttpClient struct {
-	// TODO: make this cache to LRU cache.
-	cache map[string][]byte
+	cache *lruCache
+
+	// mu guards the fields below, which setters replace rather than modify
+	// so requests in flight keep what they started with
+	mu      sync.Mutex
+	disk    *diskCache
+	client  *http.Client
+	flights map[string]*flight
+
+	// every request goes through retry, then through limiter
+	retry   *RetryTransport
+	limiter *RateLimitTransport
+	proxies *ProxyConfig
+	// set when the transport is given by the user, which proxies do not
+	// apply to
+	customTransport bool
+	// set by DisableCache
+	noCache bool
 }
 
+// flight is a fetch of GetBody in progress, which identical requests wait for.
+type flight struct {
+	done    chan struct{}
+	content []byte
+	err     error
+}
+
+// testHookWaitFlight, if not nil, is called when GetBody starts waiting for a
+// flight, so tests know every request has joined it.
+var testHookWaitFlight func()
+
 func NewCachedHttpClient() *CachedHttpClient {
-	return &CachedHttpClient{cache: make(map[string][]byte)}
+	return NewCachedHttpClientFrom(&http.Client{})
+}
+
+// NewCachedHttpClientFrom is NewCachedHttpClient sending requests with a copy
+// of client, keeping its timeout, redirect policy and transport, which
+// retrying and rate limiting wrap. The default transport is used if client
+// has none.
+func NewCachedHttpClientFrom(client *http.Client) *CachedHttpClient {
+	proxies := &ProxyConfig{}
+	transport := client.Transport
+	if transport == nil {
+		defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
+		defaultTransport.Proxy = proxies.Proxy
+		transport = defaultTransport
+	}
+	limiter := NewRateLimitTransport(transport)
+	retry := NewRetryTransport(limiter)
+	copied := *client
+	copied.Transport = retry
+	return &CachedHttpClient{
+		cache:           newLruCache(DefaultCacheEntries, DefaultCacheBytes),
+		client:          &copied,
+		flights:         make(map[string]*flight),
+		retry:           retry,
+		limiter:         limiter,
+		proxies:         proxies,
+		customTransport: client.Transport != nil,
+	}
+}
+
+// SetProxy sends the requests to the hosts matching pattern through proxy,
+// see ProxyConfig.Set. It fails if the transport is given by the user, which
+// is left to choose its proxies itself.
+func (c *CachedHttpClient) SetProxy(pattern string, proxy string) error {
+	if c.customTransport {
+		return fmt.Errorf("proxies cannot be set with a custom transport")
+	}
+	return c.proxies.Set(pattern, proxy)
+}
+
+// Proxy returns the proxy for connections to rawUrl not made by the client,
+// or nil to connect directly.
+func (c *CachedHttpClient) Proxy(rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	// the environment only knows http and https
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	return c.proxies.Proxy(&http.Request{URL: u})
+}
+
+// SetMaxAttempts sets how many times a request failing with a transient
+// error is sent, see RetryTransport. 1 disables retrying.
+func (c *CachedHttpClient) SetMaxAttempts(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	retry := *c.retry
+	retry.MaxAttempts = max(n, 1)
+	client := *c.client
+	client.Transport = &retry
+	c.retry = &retry
+	c.client = &client
+}
+
+// SetRateLimit limits the requests to the hosts matching pattern to rate
+// per second, see RateLimitTransport.SetLimit.
+func (c *CachedHttpClient) SetRateLimit(pattern string, rate float64) {
+	c.limiter.SetLimit(pattern, rate)
+}
+
+// SetCacheLimits limits the number of cached responses and their total size
+// in bytes, 0 meaning unlimited. The least recently used responses are
+// evicted first, responses larger than maxBytes are not cached at all.
+func (c *CachedHttpClient) SetCacheLimits(maxEntries int, maxBytes int64) {
+	c.cache.SetLimits(maxEntries, maxBytes)
+}
+
+// SetDiskCache keeps responses in directory dir across runs as well. ttl
+// tells how long the response of an url is fresh, 0 for not keeping it.
+// Stale responses are revalidated with their ETag or Last-Modified header.
+func (c *CachedHttpClient) SetDiskCache(dir string, ttl func(u *url.URL) time.Duration) error {
+	disk, err := newDiskCache(dir, ttl)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disk = disk
+	return nil
+}
+
+// DisableCache makes GetBody send every request like GetBodyNoCache, for
+// callers needing fresh responses, e.g. right after logging in.
+func (c *CachedHttpClient) DisableCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.noCache = true
+}
+
+// CacheStats returns the statistics of the response cache.
+func (c *CachedHttpClient) CacheStats() CacheStats {
+	return c.cache.Stats()
+}
+
+// SetCookieJar makes every request carry the cookies of jar that apply to it,
+// and stores cookies set by responses in jar.
+func (c *CachedHttpClient) SetCookieJar(jar http.CookieJar) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client := *c.client
+	client.Jar = jar
+	c.client = &client
+}
+
+// Client returns the underlying client, for requests that must not be cached.
+func (c *CachedHttpClient) Client() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// StreamClient is Client without timeout, for downloads of streams which
+// take as long as they need. Their callers watch them for stalls instead.
+func (c *CachedHttpClient) StreamClient() *http.Client {
+	client := *c.Client()
+	client.Timeout = 0
+	return &client
 }
 
 // GetBody HTTP response with 'GET' verb
+// A request identical to one in flight waits for it and gets the same
+// result, errors included. The fetch does not depend on the context of the
+// request which started it: a request whose context is done returns at once
+// while the others keep waiting.
 func (c *CachedHttpClient) GetBody(req *http.Request) ([]byte, error) {
+	c.mu.Lock()
+	noCache := c.noCache
+	c.mu.Unlock()
+	if noCache {
+		return c.GetBodyNoCache(req)
+	}
 
 	// try the cache
 	headers := map[string][]string(req.Header)
@@ -26,32 +207,130 @@ func (c *CachedHttpClient) GetBody(req *http.Request) ([]byte, error) {
 	for k, v := range headers {
 		headerArr = append(headerArr, fmt.Sprintf("%s-%v", k, v))
 	}
+	if jar := c.Client().Jar; jar != nil {
+		// the same url serves different content to different users
+		for _, cookie := range jar.Cookies(req.URL) {
+			headerArr = append(headerArr, cookie.String())
+		}
+	}
 	slices.Sort(headerArr)
 	sb := strings.Builder{}
 	sb.WriteString(req.URL.String())
 	sb.WriteString(strings.Join(headerArr, "."))
 	urlAndHeader := sb.String()
 
-	if data, ok := c.cache[urlAndHeader]; ok {
+	c.mu.Lock()
+	if data, ok := c.cache.Get(urlAndHeader); ok {
+		c.mu.Unlock()
 		return data, nil
 	}
+	// then the identical request in flight, if any
+	f, ok := c.flights[urlAndHeader]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		c.flights[urlAndHeader] = f
+		go c.fly(f, req.WithContext(context.WithoutCancel(req.Context())), urlAndHeader, c.disk)
+	}
+	c.mu.Unlock()
 
-	resp, err := http.DefaultClient.Do(req)
+	if testHookWaitFlight != nil {
+		testHookWaitFlight()
+	}
+	select {
+	case <-f.done:
+		return f.content, f.err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// fly runs the fetch of f and lets its waiters go.
+func (c *CachedHttpClient) fly(f *flight, req *http.Request, urlAndHeader string, disk *diskCache) {
+	f.content, f.err = c.fetch(req, urlAndHeader, disk)
+	c.mu.Lock()
+	delete(c.flights, urlAndHeader)
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// fetch gets the response of req from disk, or from the network, and caches
+// it under urlAndHeader.
+func (c *CachedHttpClient) fetch(req *http.Request, urlAndHeader string, disk *diskCache) ([]byte, error) {
+	var ttl time.Duration
+	var stale *diskCacheEntry
+	if disk != nil {
+		ttl = disk.ttl(req.URL)
+	}
+	if ttl > 0 {
+		if entry, err := disk.load(urlAndHeader); err == nil {
+			if time.Since(entry.StoredAt) < ttl {
+				c.cache.Add(urlAndHeader, entry.body)
+				return entry.body, nil
+			}
+			if entry.ETag != "" || entry.LastModified != "" {
+				stale = entry
+				req = req.Clone(req.Context())
+				if entry.ETag != "" {
+					req.Header.Set("If-None-Match", entry.ETag)
+				}
+				if entry.LastModified != "" {
+					req.Header.Set("If-Modified-Since", entry.LastModified)
+				}
+			}
+		}
+	}
+
+	resp, content, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("GET request got error: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		stale.StoredAt = time.Now()
+		disk.store(urlAndHeader, stale)
+		c.cache.Add(urlAndHeader, stale.body)
+		return stale.body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return content, fmt.Errorf("http status code is %d", resp.StatusCode)
+	}
+
+	c.cache.Add(urlAndHeader, content)
+	if ttl > 0 {
+		disk.store(urlAndHeader, &diskCacheEntry{
+			Url:          req.URL.String(),
+			StoredAt:     time.Now(),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			body:         content,
+		})
+	}
+	return content, nil
+}
 
-	var err2 error
+// GetBodyNoCache is GetBody bypassing the cache, for large responses or ones
+// that are never requested twice.
+func (c *CachedHttpClient) GetBodyNoCache(req *http.Request) ([]byte, error) {
+	resp, content, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusOK {
-		err2 = fmt.Errorf("http status code is %d", resp.StatusCode)
+		return content, fmt.Errorf("http status code is %d", resp.StatusCode)
 	}
+	return content, nil
+}
 
-	content, err := io.ReadAll(resp.Body)
+// do sends req and reads the whole response body.
+func (c *CachedHttpClient) do(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := c.Client().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		return nil, nil, fmt.Errorf("GET request got error: %v", err)
 	}
+	defer resp.Body.Close()
 
-	c.cache[urlAndHeader] = content
-	return content, err2
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	return resp, content, nil
 }
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests below are meant to be run with the race detector as well.
+
+// flightWaiters lets tests wait until requests wait for a flight of GetBody.
+type flightWaiters chan struct{}
+
+func countFlightWaiters(t *testing.T) flightWaiters {
+	waiters := make(flightWaiters, 64)
+	testHookWaitFlight = func() { waiters <- struct{}{} }
+	t.Cleanup(func() { testHookWaitFlight = nil })
+	return waiters
+}
+
+// Wait returns once n more requests wait.
+func (w flightWaiters) Wait(n int) {
+	for range n {
+		<-w
+	}
+}
+
+func TestGetBodyCoalescesRequests(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		fmt.Fprint(w, "content")
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClient()
+	const n = 20
+	waiting := countFlightWaiters(t)
+	results := make([][]byte, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", server.URL+"/page", nil)
+			results[i], errs[i] = c.GetBody(req)
+		}()
+	}
+	// let every goroutine join the request in flight
+	waiting.Wait(n)
+	close(release)
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expect 1 request to the server, got %d", got)
+	}
+	for i := range n {
+		if errs[i] != nil || !bytes.Equal(results[i], []byte("content")) {
+			t.Errorf("expect content, got %q and error %v", results[i], errs[i])
+		}
+	}
+}
+
+func TestGetBodyCoalescesErrors(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClient()
+	waiting := countFlightWaiters(t)
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			if _, err := c.GetBody(req); err != nil {
+				failed.Add(1)
+			}
+		}()
+	}
+	waiting.Wait(5)
+	close(release)
+	wg.Wait()
+	if failed.Load() != 5 {
+		t.Errorf("expect every request to fail, %d did", failed.Load())
+	}
+
+	// errors are not cached
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	c.GetBody(req)
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expect the failed request to be sent again, got %d requests", got)
+	}
+}
+
+func TestGetBodyLeaderCanceled(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		fmt.Fprint(w, "content")
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClient()
+	waiting := countFlightWaiters(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		_, err := c.GetBody(req)
+		leaderErr <- err
+	}()
+	var content []byte
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		content, err = c.GetBody(req)
+	}()
+	waiting.Wait(2)
+
+	// the request which started the fetch gives up, the other keeps waiting
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expect the canceled request to fail with its context, got %v", err)
+	}
+	close(release)
+	<-done
+	if err != nil || string(content) != "content" {
+		t.Errorf("expect content, got %q and error %v", content, err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expect 1 request to the server, got %d", got)
+	}
+}
+
+func TestCachedHttpClientConcurrentUse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClient()
+	c.SetCacheLimits(8, 0)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				path := fmt.Sprintf("/%d", (i+j)%16)
+				req, _ := http.NewRequest("GET", server.URL+path, nil)
+				body, err := c.GetBody(req)
+				if err != nil || string(body) != path {
+					t.Errorf("expect %s, got %q and error %v", path, body, err)
+					return
+				}
+				switch j % 10 {
+				case 0:
+					c.SetCookieJar(NewCookieJar())
+				case 1:
+					c.SetMaxAttempts(2)
+				case 2:
+					c.SetCacheLimits(4+i, 0)
+				case 3:
+					c.CacheStats()
+				case 4:
+					c.SetRateLimit("*", 0)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamClientHasNoTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "stream")
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClientFrom(&http.Client{Timeout: 50 * time.Millisecond})
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := c.GetBodyNoCache(req); err == nil {
+		t.Errorf("expect the timeout of the client to apply to GetBodyNoCache")
+	}
+	resp, err := c.StreamClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("expect no timeout for streams, got error: %v", err)
+	}
+	resp.Body.Close()
+	if c.Client().Timeout != 50*time.Millisecond {
+		t.Errorf("expect the client to keep its timeout, got %s", c.Client().Timeout)
+	}
+}
+
+func TestDisableCache(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response %d", requests.Add(1))
+	}))
+	defer server.Close()
+
+	c := NewCachedHttpClient()
+	get := func() string {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		content, err := c.GetBody(req)
+		if err != nil {
+			t.Fatalf("GetBody() returned error: %v", err)
+		}
+		return string(content)
+	}
+	get()
+	if content := get(); content != "response 1" {
+		t.Errorf("expect the cached response, got %q", content)
+	}
+	c.DisableCache()
+	if content := get(); content != "response 2" {
+		t.Errorf("expect a fresh response once the cache is disabled, got %q", content)
+	}
+	if stats := c.CacheStats(); stats.Hits != 1 {
+		t.Errorf("expect the cache not to be looked up once disabled, got %d hits", stats.Hits)
+	}
+}
@@ -169,6 +169,18 @@ func (n *JsonNode) GetString(path string) (string, error) {
 	return ret, nil
 }
 
+func (n *JsonNode) GetBool(path string) (bool, error) {
+	subnode, err := n.GetSubnode(path)
+	if err != nil {
+		return false, err
+	}
+	ret, ok := subnode.data.(bool)
+	if !ok {
+		return false, fmt.Errorf("cannot convert json node to bool")
+	}
+	return ret, nil
+}
+
 func (n *JsonNode) GetArray(path string) ([]interface{}, error) {
 	subnode, err := n.GetSubnode(path)
 	if err != nil {
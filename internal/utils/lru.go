@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache keeps the most recently used entries within a limit on their
+// number and on the total size of their values. A zero limit means no limit.
+// It is safe for concurrent use.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+	bytes   int64
+	stats   CacheStats
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+// CacheStats describes the content and the effectiveness of a cache.
+type CacheStats struct {
+	Entries   int
+	Bytes     int64
+	Hits      int
+	Misses    int
+	Evictions int
+}
+
+func newLruCache(maxEntries int, maxBytes int64) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Add stores value under key, evicting the least recently used entries to
+// stay within the limits. Values larger than the byte limit are not stored.
+func (c *lruCache) Add(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxBytes > 0 && int64(len(value)) > c.maxBytes {
+		c.remove(key)
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		c.bytes += int64(len(value) - len(entry.value))
+		entry.value = value
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+		c.bytes += int64(len(value))
+	}
+
+	c.evict()
+}
+
+// evict removes the least recently used entries until the limits are met.
+func (c *lruCache) evict() {
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *lruCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+func (c *lruCache) remove(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.value))
+}
+
+// SetLimits changes the limits, evicting entries if they are exceeded.
+func (c *lruCache) SetLimits(maxEntries int, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = maxEntries
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+func (c *lruCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
@@ -0,0 +1,40 @@
+package utils
+
+import "testing"
+
+func TestLruCache(t *testing.T) {
+	c := newLruCache(3, 10)
+	c.Add("a", []byte("aaa"))
+	c.Add("b", []byte("bbb"))
+	c.Add("c", []byte("ccc"))
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expect a to be cached")
+	}
+
+	// over the entry limit, b is the least recently used
+	c.Add("d", []byte("d"))
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expect b to be evicted")
+	}
+	// over the byte limit
+	c.Add("e", []byte("eeee"))
+	if _, ok := c.Get("c"); ok {
+		t.Errorf("expect c to be evicted")
+	}
+	// larger than the byte limit
+	c.Add("f", make([]byte, 11))
+	if _, ok := c.Get("f"); ok {
+		t.Errorf("expect f not to be cached")
+	}
+
+	stats := c.Stats()
+	expected := CacheStats{Entries: 3, Bytes: 8, Hits: 1, Misses: 3, Evictions: 2}
+	if stats != expected {
+		t.Errorf("expect stats %+v, got %+v", expected, stats)
+	}
+
+	c.SetLimits(1, 0)
+	if stats := c.Stats(); stats.Entries != 1 || stats.Bytes != 4 || stats.Evictions != 4 {
+		t.Errorf("expect only e to remain, got %+v", stats)
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProbeContentLength returns the size of the content req would download,
+// without downloading it. It asks with a HEAD request first, then with a GET
+// request for the first byte, whose Content-Range tells the size, for
+// servers that do not answer HEAD requests.
+func ProbeContentLength(client *http.Client, req *http.Request) (int64, error) {
+	head := req.Clone(req.Context())
+	head.Method = "HEAD"
+	resp, err := client.Do(head)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+			return resp.ContentLength, nil
+		}
+	}
+
+	ranged := req.Clone(req.Context())
+	ranged.Method = "GET"
+	ranged.Header.Set("Range", "bytes=0-0")
+	resp, err = client.Do(ranged)
+	if err != nil {
+		return 0, fmt.Errorf("GET request got error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		size, ok := contentRangeSize(resp.Header.Get("Content-Range"))
+		if !ok {
+			return 0, fmt.Errorf("invalid Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		// read the single byte so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		return size, nil
+	case http.StatusOK:
+		// the server ignored the range, the body is not read
+		if resp.ContentLength < 0 {
+			return 0, fmt.Errorf(`response header "Content-Length" is missing`)
+		}
+		return resp.ContentLength, nil
+	}
+	return 0, fmt.Errorf("http status code is %d", resp.StatusCode)
+}
+
+// contentRangeSize returns the complete length of a Content-Range header like
+// "bytes 0-0/12345".
+func contentRangeSize(value string) (int64, bool) {
+	_, size, ok := strings.Cut(value, "/")
+	if !ok || !strings.HasPrefix(value, "bytes ") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
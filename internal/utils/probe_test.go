@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProbeContentLength(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 100000)
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{name: "head", handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "HEAD" {
+				t.Errorf("expect no GET request when HEAD is answered")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}},
+		{name: "range", handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("expect a request for the first byte, got range %q", r.Header.Get("Range"))
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}},
+		{name: "range ignored", handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			size, err := ProbeContentLength(http.DefaultClient, req)
+			if err != nil {
+				t.Fatalf("ProbeContentLength() returned error: %v", err)
+			}
+			if size != int64(len(content)) {
+				t.Errorf("expect size %d, got %d", len(content), size)
+			}
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := ProbeContentLength(http.DefaultClient, req); err == nil {
+		t.Errorf("expect error when the server refuses both requests")
+	}
+}
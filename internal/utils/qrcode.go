@@ -0,0 +1,470 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QrCode is a QR code symbol encoding bytes with error correction level M.
+// Only versions 1 to 10 are supported, which is enough for login urls.
+type QrCode struct {
+	Version int
+	Size    int
+	// Modules[y][x] is true for dark modules
+	Modules [][]bool
+
+	isFunction [][]bool
+}
+
+type qrVersionInfo struct {
+	ecPerBlock int
+	// number of data codewords of each block
+	blocks []int
+	// centers of alignment patterns
+	alignment []int
+}
+
+// error correction level M
+var qrVersions = []qrVersionInfo{
+	{},
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+const qrFormatBitsM = 0
+
+// NewQrCode encodes data in byte mode using the smallest version that fits.
+func NewQrCode(data []byte) (*QrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		if qrByteCapacity(v) >= len(data) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("data of %d bytes is too long for a QR code", len(data))
+	}
+
+	q := &QrCode{Version: version, Size: version*4 + 17}
+	q.Modules = make([][]bool, q.Size)
+	q.isFunction = make([][]bool, q.Size)
+	for i := range q.Modules {
+		q.Modules[i] = make([]bool, q.Size)
+		q.isFunction[i] = make([]bool, q.Size)
+	}
+
+	q.drawFunctionPatterns()
+	q.drawCodewords(q.addEcAndInterleave(qrDataCodewords(version, data)))
+
+	// choose the mask with the lowest penalty
+	bestMask, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		penalty := q.penalty()
+		if minPenalty < 0 || penalty < minPenalty {
+			bestMask, minPenalty = mask, penalty
+		}
+		// masking is an XOR, applying it again reverts it
+		q.applyMask(mask)
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(bestMask)
+	q.isFunction = nil
+	return q, nil
+}
+
+// String renders the symbol with half blocks, two rows of modules per line,
+// surrounded by a quiet zone. Light modules are drawn as blocks, which suits
+// terminals with a dark background.
+func (q *QrCode) String() string {
+	const border = 2
+	isLight := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= q.Size || y >= q.Size {
+			return true
+		}
+		return !q.Modules[y][x]
+	}
+	var sb strings.Builder
+	for y := -border; y < q.Size+border; y += 2 {
+		for x := -border; x < q.Size+border; x++ {
+			top, bottom := isLight(x, y), isLight(x, y+1)
+			if y+1 >= q.Size+border {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				sb.WriteRune('█')
+			case top:
+				sb.WriteRune('▀')
+			case bottom:
+				sb.WriteRune('▄')
+			default:
+				sb.WriteRune(' ')
+			}
+		}
+		sb.WriteRune('\n')
+	}
+	return sb.String()
+}
+
+func qrDataCodewordCount(version int) int {
+	n := 0
+	for _, b := range qrVersions[version].blocks {
+		n += b
+	}
+	return n
+}
+
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+func qrByteCapacity(version int) int {
+	return (qrDataCodewordCount(version)*8 - 4 - qrCountBits(version)) / 8
+}
+
+// qrDataCodewords builds the data codewords: mode indicator, character count,
+// the data, terminator and padding.
+func qrDataCodewords(version int, data []byte) []byte {
+	var bits []bool
+	appendBits := func(val int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>i)&1 == 1)
+		}
+	}
+	appendBits(0x4, 4) // byte mode
+	appendBits(len(data), qrCountBits(version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	capacity := qrDataCodewordCount(version) * 8
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	result := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			result[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+	return result
+}
+
+func (q *QrCode) addEcAndInterleave(data []byte) []byte {
+	info := qrVersions[q.Version]
+	divisor := rsDivisor(info.ecPerBlock)
+	dataBlocks := make([][]byte, len(info.blocks))
+	ecBlocks := make([][]byte, len(info.blocks))
+	k := 0
+	for i, n := range info.blocks {
+		dataBlocks[i] = data[k : k+n]
+		ecBlocks[i] = rsRemainder(dataBlocks[i], divisor)
+		k += n
+	}
+
+	result := make([]byte, 0, len(data)+info.ecPerBlock*len(info.blocks))
+	longest := info.blocks[len(info.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+func (q *QrCode) setFunctionModule(x, y int, dark bool) {
+	q.Modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *QrCode) drawFunctionPatterns() {
+	// timing patterns
+	for i := 0; i < q.Size; i++ {
+		q.setFunctionModule(6, i, i%2 == 0)
+		q.setFunctionModule(i, 6, i%2 == 0)
+	}
+
+	// finder patterns, including separators
+	for _, c := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= q.Size || y >= q.Size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				q.setFunctionModule(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	// alignment patterns, except those overlapping the finder patterns
+	positions := qrVersions[q.Version].alignment
+	n := len(positions)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunctionModule(positions[i]+dx, positions[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas, the real bits are drawn after masking
+	q.drawFormatBits(0)
+	q.drawVersionBits()
+}
+
+func (q *QrCode) drawFormatBits(mask int) {
+	data := qrFormatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return (bits>>i)&1 == 1
+	}
+
+	// first copy, around the top left finder
+	for i := 0; i <= 5; i++ {
+		q.setFunctionModule(8, i, bit(i))
+	}
+	q.setFunctionModule(8, 7, bit(6))
+	q.setFunctionModule(8, 8, bit(7))
+	q.setFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunctionModule(14-i, 8, bit(i))
+	}
+
+	// second copy, split between the other two finders
+	for i := 0; i < 8; i++ {
+		q.setFunctionModule(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunctionModule(8, q.Size-15+i, bit(i))
+	}
+	// always dark
+	q.setFunctionModule(8, q.Size-8, true)
+}
+
+func (q *QrCode) drawVersionBits() {
+	if q.Version < 7 {
+		return
+	}
+	rem := q.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := q.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a, b := q.Size-11+i%3, i/3
+		q.setFunctionModule(a, b, dark)
+		q.setFunctionModule(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a
+// time from the bottom right corner, skipping the function patterns.
+func (q *QrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// skip the vertical timing pattern
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					// upward
+					y = q.Size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(codewords)*8 {
+					q.Modules[y][x] = (codewords[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QrCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.isFunction[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				q.Modules[y][x] = !q.Modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the rules of ISO/IEC 18004 section 7.8.3.
+func (q *QrCode) penalty() int {
+	result := 0
+	at := func(x, y int, horizontal bool) bool {
+		if horizontal {
+			return q.Modules[y][x]
+		}
+		return q.Modules[x][y]
+	}
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < q.Size; y++ {
+			// runs of the same color
+			run := 1
+			for x := 1; x < q.Size; x++ {
+				if at(x, y, horizontal) == at(x-1, y, horizontal) {
+					run++
+					if run == 5 {
+						result += 3
+					} else if run > 5 {
+						result++
+					}
+				} else {
+					run = 1
+				}
+			}
+
+			// finder-like patterns
+			for x := 0; x+11 <= q.Size; x++ {
+				for _, pattern := range finderLike {
+					matched := true
+					for k, dark := range pattern {
+						if at(x+k, y, horizontal) != dark {
+							matched = false
+							break
+						}
+					}
+					if matched {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.Modules[y][x] {
+				dark++
+			}
+			if x+1 < q.Size && y+1 < q.Size {
+				c := q.Modules[y][x]
+				if c == q.Modules[y][x+1] && c == q.Modules[y+1][x] && c == q.Modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	// balance of dark and light modules
+	total := q.Size * q.Size
+	result += abs(dark*20-total*10) / total * 10
+	return result
+}
+
+// rsDivisor returns the generator polynomial of the given degree, without
+// the leading coefficient.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The expected symbols in testdata were made by another encoder, with "#" for
+// dark modules and "." for light ones.
+func TestNewQrCode(t *testing.T) {
+	loginUrl := "https://passport.bilibili.com/h5-app/passport/login/scan?navhide=1&qrcode_key=d41d8cd98f00b204e9800998ecf8427e&from=cli"
+	for _, tc := range []struct {
+		name    string
+		data    string
+		version int
+	}{
+		// alignment pattern
+		{name: "qrcode_v2", data: "https://www.bilibili.com/", version: 2},
+		// several alignment patterns and version information
+		{name: "qrcode_v7", data: loginUrl, version: 7},
+		// 16 bits character count
+		{name: "qrcode_v10", data: loginUrl + "&gourl=https%3A%2F%2Fwww.bilibili.com%2Fvideo%2FBV1xx411c7mD%2F%3Fspm_id_from=333.1007", version: 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("testdata", tc.name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := strings.Fields(string(content))
+
+			q, err := NewQrCode([]byte(tc.data))
+			if err != nil {
+				t.Fatalf("NewQrCode() returned error: %v", err)
+			}
+			if q.Version != tc.version || q.Size != len(expected) {
+				t.Fatalf("expect version %d of size %d, got version %d of size %d", tc.version, len(expected), q.Version, q.Size)
+			}
+			for y, row := range q.Modules {
+				var sb strings.Builder
+				for _, dark := range row {
+					if dark {
+						sb.WriteByte('#')
+					} else {
+						sb.WriteByte('.')
+					}
+				}
+				if sb.String() != expected[y] {
+					t.Errorf("row %d: expect %s, got %s", y, expected[y], sb.String())
+				}
+			}
+		})
+	}
+
+	if _, err := NewQrCode(make([]byte, qrByteCapacity(len(qrVersions)-1)+1)); err == nil {
+		t.Errorf("expect error for data too long")
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitTransport is an http.RoundTripper limiting the requests to every
+// host with a token bucket. Limits are set per host pattern; a host getting
+// 412 responses, which is how Bilibili answers clients going too fast, is
+// slowed down and recovers gradually with the following successes.
+type RateLimitTransport struct {
+	Base http.RoundTripper
+
+	mu      sync.Mutex
+	rules   []rateRule
+	buckets map[string]*tokenBucket
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+type rateRule struct {
+	pattern string
+	rate    float64
+}
+
+// a throttled host is never slowed down below this rate
+const minThrottledRate = 0.2
+
+type tokenBucket struct {
+	limit  float64 // configured requests per second
+	rate   float64 // current requests per second, lower when throttled
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimitTransport(base http.RoundTripper) *RateLimitTransport {
+	return &RateLimitTransport{
+		Base:    base,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MatchHost tells whether host matches pattern, which is a host name, "*"
+// for every host, or "*.example.com" for example.com and its subdomains.
+func MatchHost(pattern string, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return false
+}
+
+// SetLimit limits the hosts matching pattern, see MatchHost, to rate
+// requests per second, 0 meaning unlimited. The limit set last wins for
+// hosts matching several patterns.
+func (t *RateLimitTransport) SetLimit(pattern string, rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules = append(t.rules, rateRule{pattern: pattern, rate: max(rate, 0)})
+	// buckets are created again with the new limits
+	clear(t.buckets)
+}
+
+func (t *RateLimitTransport) limitOf(host string) float64 {
+	for i := len(t.rules) - 1; i >= 0; i-- {
+		if MatchHost(t.rules[i].pattern, host) {
+			return t.rules[i].rate
+		}
+	}
+	return 0
+}
+
+// bucket returns the bucket of host, or nil if host is unlimited.
+func (t *RateLimitTransport) bucket(host string) *tokenBucket {
+	if b, ok := t.buckets[host]; ok {
+		return b
+	}
+	limit := t.limitOf(host)
+	if limit == 0 {
+		t.buckets[host] = nil
+		return nil
+	}
+	b := &tokenBucket{limit: limit, rate: limit, tokens: burst(limit), last: t.now()}
+	t.buckets[host] = b
+	return b
+}
+
+// burst is how many requests may be sent at once after a quiet period.
+func burst(rate float64) float64 {
+	return max(math.Ceil(rate), 1)
+}
+
+// wait takes a token from the bucket of host, sleeping until one is
+// available. Tokens are reserved before sleeping, so concurrent requests
+// queue up instead of all waking up at once.
+func (t *RateLimitTransport) wait(ctx context.Context, host string) error {
+	t.mu.Lock()
+	b := t.bucket(host)
+	if b == nil {
+		t.mu.Unlock()
+		return nil
+	}
+	now := t.now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, burst(b.rate))
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if delay > 0 {
+		return t.sleep(ctx, delay)
+	}
+	return nil
+}
+
+// observe adapts the rate of host to the status code of a response:
+// halved on a 412, raised by a tenth of the limit on a success.
+func (t *RateLimitTransport) observe(host string, status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[host]
+	if b == nil {
+		return
+	}
+	switch {
+	case status == http.StatusPreconditionFailed:
+		b.rate = max(b.rate/2, min(minThrottledRate, b.limit))
+		b.tokens = min(b.tokens, 0)
+	case status < 400 && b.rate < b.limit:
+		b.rate = min(b.rate+b.limit/10, b.limit)
+	}
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	host := req.URL.Hostname()
+	if err := t.wait(req.Context(), host); err != nil {
+		return nil, err
+	}
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		t.observe(host, resp.StatusCode)
+	}
+	return resp, err
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMatchHost(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		expected      bool
+	}{
+		{"*", "example.com", true},
+		{"api.bilibili.com", "API.bilibili.com", true},
+		{"*.bilibili.com", "bilibili.com", true},
+		{"*.bilibili.com", "api.live.bilibili.com", true},
+		{"*.bilibili.com", "notbilibili.com", false},
+		{"api.bilibili.com", "www.bilibili.com", false},
+	}
+	for _, c := range cases {
+		if got := MatchHost(c.pattern, c.host); got != c.expected {
+			t.Errorf("MatchHost(%s, %s): expect %v, got %v", c.pattern, c.host, c.expected, got)
+		}
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host, _ := url.Parse(server.URL)
+
+	clock := time.Unix(0, 0)
+	waited := time.Duration(0)
+	transport := NewRateLimitTransport(nil)
+	transport.now = func() time.Time { return clock }
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		waited += d
+		clock = clock.Add(d)
+		return nil
+	}
+	transport.SetLimit("*", 0)
+	transport.SetLimit(host.Hostname(), 2)
+	client := &http.Client{Transport: transport}
+	get := func() {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() returned error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// a burst of 2, then one request every half second
+	for range 4 {
+		get()
+	}
+	if waited != time.Second {
+		t.Errorf("expect to wait 1s for 4 requests, waited %v", waited)
+	}
+
+	status = http.StatusPreconditionFailed
+	get()
+	if rate := transport.buckets[host.Hostname()].rate; rate != 1 {
+		t.Errorf("expect the rate to be halved after a 412, got %v", rate)
+	}
+	status = http.StatusOK
+	for range 6 {
+		get()
+	}
+	if rate := transport.buckets[host.Hostname()].rate; rate != 2 {
+		t.Errorf("expect the rate to recover after successes, got %v", rate)
+	}
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// default retry policy
+const (
+	DefaultMaxAttempts = 3
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 10 * time.Second
+	// a server asking to wait longer than this is not waited for
+	maxRetryAfter = time.Minute
+)
+
+// RetryTransport is an http.RoundTripper that retries requests failing with
+// transient errors: timeouts, broken connections, 5xx responses, and 429 or
+// 412 responses, the latter being what Bilibili answers when it throttles.
+// Delays grow exponentially from BaseDelay up to MaxDelay with jitter, unless
+// the response tells how long to wait with Retry-After.
+//
+// Only requests which can be sent twice safely are retried: GET, HEAD and
+// OPTIONS requests whose body, if any, can be recreated.
+type RetryTransport struct {
+	Base        http.RoundTripper
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	sleep func(time.Duration)
+}
+
+func NewRetryTransport(base http.RoundTripper) *RetryTransport {
+	return &RetryTransport{
+		Base:        base,
+		MaxAttempts: DefaultMaxAttempts,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	retryable := req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS"
+	retryable = retryable && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := base.RoundTrip(req)
+		if !retryable || attempt >= t.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		var delay time.Duration
+		if err != nil {
+			if !isTransientError(err) {
+				return resp, err
+			}
+			delay = t.backoff(attempt)
+		} else {
+			if !isTransientStatus(resp.StatusCode) {
+				return resp, err
+			}
+			delay = t.backoff(attempt)
+			if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				if after > maxRetryAfter {
+					return resp, err
+				}
+				delay = after
+			}
+			// read a little so the connection can be reused
+			io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+
+		if !t.wait(req, delay) {
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// backoff returns the delay before attempt+1, somewhere between half and the
+// whole of the exponential delay so that clients do not retry in lockstep.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	delay := t.BaseDelay << (attempt - 1)
+	if delay > t.MaxDelay || delay <= 0 {
+		delay = t.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// wait sleeps for delay, returning false if the request is canceled meanwhile.
+func (t *RetryTransport) wait(req *http.Request, delay time.Duration) bool {
+	if t.sleep != nil {
+		t.sleep(delay)
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusPreconditionFailed,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isTransientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// retryAfter parses the Retry-After header, either seconds or a date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusPreconditionFailed, http.StatusOK}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[min(requests, len(statuses)-1)]
+		requests++
+		if status == http.StatusPreconditionFailed {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	delays := make([]time.Duration, 0)
+	transport := NewRetryTransport(nil)
+	transport.sleep = func(d time.Duration) { delays = append(delays, d) }
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 3 {
+		t.Errorf("expect success on the third attempt, got %d after %d requests", resp.StatusCode, requests)
+	}
+	if len(delays) != 2 || delays[0] < defaultBaseDelay/2 || delays[0] > defaultBaseDelay || delays[1] != 7*time.Second {
+		t.Errorf("expect a jittered backoff then the Retry-After delay, got %v", delays)
+	}
+
+	// out of attempts
+	requests = 0
+	transport.MaxAttempts = 2
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed || requests != 2 {
+		t.Errorf("expect the last failure after 2 requests, got %d after %d requests", resp.StatusCode, requests)
+	}
+
+	// not idempotent
+	requests = 0
+	resp, err = client.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Post() returned error: %v", err)
+	}
+	resp.Body.Close()
+	if requests != 1 {
+		t.Errorf("expect POST not to be retried, got %d requests", requests)
+	}
+}
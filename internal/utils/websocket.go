@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A minimal websocket client (RFC 6455), enough for servers pushing binary
+// messages. Extensions like permessage-deflate are not negotiated.
+
+const (
+	WebsocketText   = 1
+	WebsocketBinary = 2
+
+	websocketContinuation = 0
+	websocketClose        = 8
+	websocketPing         = 9
+	websocketPong         = 10
+
+	websocketGuid           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketMaxMessageSize = 16 << 20
+	websocketDialTimeout    = 30 * time.Second
+)
+
+type WebsocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// frames are written by the reading goroutine as well, e.g. pongs
+	writeMu sync.Mutex
+}
+
+// DialWebsocket connects to a ws:// or wss:// url, sending header with the
+// opening handshake. proxy, if not nil, is an http, https or socks5 proxy to
+// connect through.
+func DialWebsocket(rawUrl string, header http.Header, proxy *url.URL) (*WebsocketConn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	dialer := &net.Dialer{Timeout: websocketDialTimeout}
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialProxy(dialer, proxy, host)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(websocketDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+		Host:       u.Host,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(websocketDialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send websocket handshake: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read websocket handshake: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake got http status code %d", resp.StatusCode)
+	}
+	accept := sha1.Sum([]byte(key + websocketGuid))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake got invalid Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &WebsocketConn{conn: conn, reader: reader}, nil
+}
+
+// WriteMessage sends data as a single frame of the given message type,
+// WebsocketText or WebsocketBinary.
+func (c *WebsocketConn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(byte(messageType), data)
+}
+
+func (c *WebsocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	// clients always mask
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// ReadMessage returns the type and the content of the next text or binary
+// message, answering pings on the way. It returns io.EOF once the server
+// closes the connection.
+func (c *WebsocketConn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := make([]byte, 0)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case websocketPing:
+			if err := c.writeFrame(websocketPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocketPong:
+			continue
+		case websocketClose:
+			c.writeFrame(websocketClose, payload)
+			return 0, nil, io.EOF
+		case websocketContinuation:
+			if messageType == 0 {
+				return 0, nil, fmt.Errorf("unexpected websocket continuation frame")
+			}
+		case WebsocketText, WebsocketBinary:
+			if messageType != 0 {
+				return 0, nil, fmt.Errorf("websocket message interrupted by a new message")
+			}
+			messageType = int(opcode)
+		default:
+			return 0, nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+
+		if len(message)+len(payload) > websocketMaxMessageSize {
+			return 0, nil, fmt.Errorf("websocket message is larger than %d bytes", websocketMaxMessageSize)
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+func (c *WebsocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > websocketMaxMessageSize {
+		err = fmt.Errorf("websocket frame is larger than %d bytes", websocketMaxMessageSize)
+		return
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Close closes the connection without the closing handshake, which also
+// unblocks a pending ReadMessage.
+func (c *WebsocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebsocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGuid))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+		// a ping, then a binary message in two fragments
+		rw.Write([]byte{0x89, 0})
+		rw.Write([]byte{0x02, 3, 'a', 'b', 'c'})
+		rw.Write([]byte{0x80, 2, 'd', 'e'})
+		rw.Flush()
+
+		// the pong and then the echo of the client, which must be masked
+		server := &WebsocketConn{conn: conn, reader: bufio.NewReader(rw)}
+		fin, opcode, _, err := server.readFrame()
+		if err != nil || !fin || opcode != websocketPong {
+			t.Errorf("expect pong, got opcode %d, error %v", opcode, err)
+			return
+		}
+		_, message, err := server.ReadMessage()
+		if err != nil {
+			t.Errorf("failed to read client message: %v", err)
+			return
+		}
+		conn.Write(append([]byte{0x81, byte(len(message))}, message...))
+		conn.Write([]byte{0x88, 0})
+	}))
+	defer server.Close()
+
+	conn, err := DialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), nil, nil)
+	if err != nil {
+		t.Fatalf("DialWebsocket() returned error: %v", err)
+	}
+	defer conn.Close()
+
+	messageType, message, err := conn.ReadMessage()
+	if err != nil || messageType != WebsocketBinary || string(message) != "abcde" {
+		t.Fatalf("expect binary message abcde, got %d %q %v", messageType, message, err)
+	}
+	if err := conn.WriteMessage(WebsocketText, []byte("echo")); err != nil {
+		t.Fatalf("WriteMessage() returned error: %v", err)
+	}
+	messageType, message, err = conn.ReadMessage()
+	if err != nil || messageType != WebsocketText || string(message) != "echo" {
+		t.Fatalf("expect text message echo, got %d %q %v", messageType, message, err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("expect error after the server closes")
+	}
+}